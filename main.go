@@ -4,58 +4,337 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"./process"
 )
 
-func toString(scanner *bufio.Scanner) (string, error) {
-	output := ""
-	for scanner.Scan() {
-		output += scanner.Text() + "\n"
+// The name the default theme is written under, beside the html
+const themeName = "marginalia.css"
+
+func writeOutput(outName string, output string) {
+	if outName == "" {
+		fmt.Println(output)
+		return
+	}
+	err := os.WriteFile(outName, []byte(output+"\n"), 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// A document written a collection at a time
+type collectionWriter interface {
+	Write(cc process.Collection) error
+	Close() error
+}
+
+// Marginalia text as Justification.Lines lays it out
+type textWriter struct {
+	writer io.Writer
+	jj     process.Justification
+	count  int
+}
+
+func (tw *textWriter) Write(cc process.Collection) error {
+	lines, err := tw.jj.Lines([]process.Collection{cc})
+	if err != nil {
+		return err
+	}
+	text := strings.Join(lines, "\n")
+	if tw.count != 0 {
+		text = "\n\n" + text
+	}
+	tw.count++
+	_, err = io.WriteString(tw.writer, text)
+	return err
+}
+
+func (tw *textWriter) Close() error {
+	return nil
+}
+
+// Normalize text a line at a time as it is read. No line break combines
+// with the characters around it.
+func normalizeLines(rr io.Reader) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		reader := bufio.NewReader(rr)
+		for {
+			ll, err := reader.ReadString('\n')
+			if _, err := io.WriteString(pw, process.Normalize(ll)); err != nil {
+				return
+			}
+			if err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				pw.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	return pr
+}
+
+// Write a text document a collection at a time as it is read, so that
+// memory grows with the longest paragraph rather than with the document
+func streamOutput(input io.Reader, outName string, newWriter func(io.Writer) collectionWriter) {
+	var output io.Writer = os.Stdout
+	if outName != "" {
+		file, err := os.OpenFile(outName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer file.Close()
+		output = file
+	}
+	buffered := bufio.NewWriter(output)
+	writer := newWriter(buffered)
+
+	importer := process.ImportReader(input)
+	for {
+		cc, err := importer.Next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = writer.Write(cc)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintln(buffered)
+	if err := buffered.Flush(); err != nil {
+		log.Fatal(err)
 	}
-	return output, scanner.Err()
 }
 
 func main() {
 
 	var reformat bool
 	var fileName string
+	var width int
+	var noteWidth int
+	var stylesheet string
+	var normalize bool
+	var contents string
+	var footnotes string
+	var endnotes string
+	var profile string
+	var outName string
+	var theme bool
+	var flow string
+	var check bool
+	var to string
+	var from string
 
 	flag.BoolVar(&reformat, "reformat", false, "reformat margins")
 	flag.StringVar(&fileName, "file", "", "filename to convert (default: stdin)")
+	flag.IntVar(&width, "width", 60, "main text column width when reformatting (0: no wrapping)")
+	flag.IntVar(&noteWidth, "notewidth", 16, "sidenote channel width when reformatting")
+	flag.StringVar(&stylesheet, "css", "", "stylesheet to link from the html head")
+	flag.BoolVar(&normalize, "normalize", false, "rewrite the text to NFC before reading it")
+	flag.StringVar(&footnotes, "footnotes", "inline", "footnote marks in html: \"inline\", \"numbers\" or \"symbols\"")
+	flag.StringVar(&endnotes, "endnotes", "document", "where numbered footnotes go: \"document\" or \"chapter\"")
+	flag.StringVar(&profile, "profile", "plain", "note layout in html: \"plain\" or \"margins\"")
+	flag.StringVar(&outName, "out", "", "file to write to (default: stdout)")
+	flag.BoolVar(&theme, "theme", true, "write the default theme beside the html file given with -out, and link it")
+	flag.StringVar(&flow, "flow", "", "print the flow text instead, with notes \"dropped\" or as \"numbers\"")
+	flag.BoolVar(&check, "check", false, "fail if the text, or each file named after the flags, is not as -reformat would lay it out")
+	flag.StringVar(&contents, "toc", "", "print the table of contents instead, as \"html\" or \"text\"")
+	flag.StringVar(&to, "to", "html", "output format: \"html\", \"text\" (as -reformat), \"json\" or \"tei\"")
+	flag.StringVar(&from, "from", "text", "input format: \"text\" or \"json\"")
 	flag.Parse()
 
-	text := ""
+	jj := process.Justification{Width: width, NoteWidth: noteWidth}
+	if check && flag.NArg() != 0 {
+		failed := false
+		for _, name := range flag.Args() {
+			file, err := os.Open(name)
+			if err == nil {
+				err = process.CheckReader(file, jj)
+				file.Close()
+			}
+			if err != nil {
+				for _, line := range strings.Split(err.Error(), "\n") {
+					fmt.Fprintln(os.Stderr, name+":"+line)
+				}
+				failed = true
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+		return
+	}
 
-	if fileName == "" {
-		scanner := bufio.NewScanner(os.Stdin)
-		var err error
-		text, err = toString(scanner)
+	var input io.Reader = os.Stdin
+	if fileName != "" {
+		file, err := os.Open(fileName)
 		if err != nil {
 			log.Fatal(err)
 		}
-	} else {
-		var err error
-		file, err := os.Open(fileName)
+		defer file.Close()
+		input = file
+	}
+	if normalize {
+		input = normalizeLines(input)
+	}
+
+	if check {
+		if from != "text" {
+			log.Fatal("Only text can be checked")
+		}
+		if err := process.CheckReader(input, jj); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	flowOpts := process.FlowOptions{}
+	switch flow {
+	case "", "dropped":
+	case "numbers":
+		flowOpts.NoteNumbers = true
+	default:
+		log.Fatal("Unknown flow note style: " + flow)
+	}
+	if reformat {
+		to = "text"
+	}
+
+	// Outputs that need nothing from further on in the document are
+	// written as it is read
+	if from == "text" && contents == "" {
+		var newWriter func(ww io.Writer) collectionWriter
+		switch {
+		case flow != "":
+			newWriter = func(ww io.Writer) collectionWriter {
+				return process.NewFlowWriter(ww, flowOpts)
+			}
+		case to == "text":
+			newWriter = func(ww io.Writer) collectionWriter {
+				return &textWriter{writer: ww, jj: jj}
+			}
+		case to == "json":
+			newWriter = func(ww io.Writer) collectionWriter {
+				return process.NewJsonWriter(ww)
+			}
+		}
+		if newWriter != nil {
+			streamOutput(input, outName, newWriter)
+			return
+		}
+	}
+
+	data, err := io.ReadAll(input)
+	if err != nil {
+		log.Fatal(err)
+	}
+	text := string(data)
+
+	var coll []process.Collection
+	switch from {
+	case "text":
+		coll, err = process.Import(text)
+	case "json":
+		coll, err = process.ImportJson(text)
+	default:
+		log.Fatal("Unknown input format: " + from)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if contents != "" {
+		toc := process.TableOfContents(coll)
+		for _, warning := range toc.Warnings {
+			log.Println(warning)
+		}
+		switch contents {
+		case "html":
+			writeOutput(outName, toc.ToHtml())
+		case "text":
+			writeOutput(outName, strings.Join(toc.ToStrings(), "\n"))
+		default:
+			log.Fatal("Unknown table of contents format: " + contents)
+		}
+		return
+	}
+
+	if flow != "" {
+		writeOutput(outName, process.FlowText(coll, flowOpts))
+		return
+	}
+
+	switch to {
+	case "html":
+		opts := process.HtmlOptions{Stylesheet: stylesheet}
+		switch footnotes {
+		case "inline":
+		case "numbers":
+			opts.Footnotes = process.NumberedFootnotes
+		case "symbols":
+			opts.Footnotes = process.SymbolFootnotes
+		default:
+			log.Fatal("Unknown footnote style: " + footnotes)
+		}
+		switch endnotes {
+		case "document":
+		case "chapter":
+			opts.Endnotes = process.ChapterEndnotes
+		default:
+			log.Fatal("Unknown endnote placement: " + endnotes)
+		}
+		switch profile {
+		case "plain":
+		case "margins":
+			opts.Profile = process.MarginProfile
+		default:
+			log.Fatal("Unknown html profile: " + profile)
+		}
+		if outName != "" && theme {
+			themeFile := filepath.Join(filepath.Dir(outName), themeName)
+			err := os.WriteFile(themeFile, []byte(process.ThemeStylesheet), 0644)
+			if err != nil {
+				log.Fatal(err)
+			}
+			opts.Theme = themeName
+		}
+
+		output, err := process.HtmlDocument(coll, opts)
 		if err != nil {
 			log.Fatal(err)
 		}
-		scanner := bufio.NewScanner(file)
-		text, err = toString(scanner)
+		writeOutput(outName, output)
+	case "text":
+		lines, err := jj.Lines(coll)
 		if err != nil {
 			log.Fatal(err)
 		}
-	}
-
-	if !reformat {
-		var err error
-		output, err := process.Convert(text)
+		writeOutput(outName, strings.Join(lines, "\n"))
+	case "json":
+		output, err := process.JsonDocument(coll)
 		if err != nil {
 			log.Fatal(err)
 		}
-		fmt.Println(output)
-	} else {
+		writeOutput(outName, output)
+	case "tei":
+		output, err := process.TeiDocument(coll)
+		if err != nil {
+			log.Fatal(err)
+		}
+		writeOutput(outName, output)
+	default:
+		log.Fatal("Unknown output format: " + to)
 	}
 }
@@ -0,0 +1,97 @@
+package process
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Greek letters in the Latin alphabet, for anchors that survive being
+// put in a url
+var greekLetters = map[rune]string{
+	'α': "a", 'β': "b", 'γ': "g", 'δ': "d", 'ε': "e", 'ζ': "z",
+	'η': "e", 'θ': "th", 'ι': "i", 'κ': "k", 'λ': "l", 'μ': "m",
+	'ν': "n", 'ξ': "x", 'ο': "o", 'π': "p", 'ρ': "r", 'σ': "s",
+	'ς': "s", 'τ': "t", 'υ': "y", 'φ': "ph", 'χ': "ch", 'ψ': "ps",
+	'ω': "o", 'ϝ': "w", 'ϙ': "q", 'ϡ': "ss",
+}
+
+const roughBreathing = '̔'
+
+// Transliterate Greek and drop diacritics. A rough breathing becomes an
+// h at the start of its word, upsilon after a vowel is u and gamma
+// before a velar is n.
+func transliterate(input string) string {
+	letters := []rune{}
+	rough := map[int]bool{}
+	for _, rr := range strings.ToLower(input) {
+		parts := decompose(rr, []rune{})
+		if combiningClass(parts[0]) != 0 {
+			continue
+		}
+		letters = append(letters, parts[0])
+		for _, mark := range parts[1:] {
+			if mark == roughBreathing {
+				rough[len(letters)-1] = true
+			}
+		}
+	}
+
+	isVowel := func(rr rune) bool {
+		return strings.ContainsRune("αεηιουω", rr)
+	}
+
+	output := ""
+	wordStart := 0
+	for ii, rr := range letters {
+		if ii == 0 || !unicode.IsLetter(letters[ii-1]) {
+			wordStart = len(output)
+		}
+		latin, greek := greekLetters[rr]
+		switch {
+		case !greek:
+			output += string(rr)
+			continue
+		case rr == 'υ' && ii != 0 && strings.ContainsRune("αεηο", letters[ii-1]):
+			latin = "u"
+		case rr == 'γ' && ii+1 < len(letters) && strings.ContainsRune("γκξχ", letters[ii+1]):
+			latin = "n"
+		}
+		if rough[ii] {
+			if rr == 'ρ' {
+				latin += "h"
+			} else if isVowel(rr) && len(output)-wordStart <= 2 {
+				output = output[:wordStart] + "h" + output[wordStart:]
+			}
+		}
+		output += latin
+	}
+	return output
+}
+
+// The anchor for a header: its text transliterated, in lower case, with
+// anything but letters and digits between words made a single hyphen
+func slug(text string) string {
+	words := strings.FieldsFunc(transliterate(text), func(rr rune) bool {
+		return !(rr < unicode.MaxASCII && (unicode.IsLetter(rr) || unicode.IsDigit(rr)))
+	})
+	if len(words) == 0 {
+		return "section"
+	}
+	return strings.Join(words, "-")
+}
+
+// The anchors given out in one document
+type anchorSet map[string]bool
+
+// Give a header its anchor. A header whose anchor is taken is numbered
+// to keep it apart; TableOfContents warns of it.
+func (as anchorSet) assign(hh *Header) {
+	id := slug(plainText(hh.Elements))
+	base := id
+	for nn := 2; as[id]; nn++ {
+		id = base + "-" + strconv.Itoa(nn)
+	}
+	as[id] = true
+	hh.Id = id
+}
@@ -5,3 +5,4 @@ const ring string = "˚"
 const dot string = "˙"
 const lquo string = "“"
 const rquo string = "”"
+const citation string = "‖"
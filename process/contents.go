@@ -0,0 +1,138 @@
+package process
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ContentsEntry is a header in a table of contents, with the headers
+// below it
+type ContentsEntry struct {
+	Header   *Header
+	Children []*ContentsEntry
+}
+
+// Contents is a table of contents built from the headers of a document.
+// Warnings describe headers that skip a level, and headers numbered
+// apart from an earlier one with the same anchor.
+type Contents struct {
+	Entries  []*ContentsEntry
+	Warnings []string
+}
+
+// TableOfContents nests the headers of a document by level. A header
+// more than one level below the one before it is nested directly under
+// it, with a warning, as is a first header below level 1.
+func TableOfContents(coll []Collection) Contents {
+	contents := Contents{}
+	stack := []*ContentsEntry{}
+	anchors := map[string]bool{}
+	for _, cc := range coll {
+		hh, ok := cc.(*Header)
+		if !ok {
+			continue
+		}
+		id := slug(plainText(hh.Elements))
+		if anchors[id] && entryAnchor(hh) != id {
+			contents.Warnings = append(contents.Warnings,
+				fmt.Sprintf("Duplicate anchor %s: \"%s\" is %s",
+					id, plainText(hh.Elements), entryAnchor(hh)))
+		}
+		anchors[id] = true
+		for len(stack) != 0 && stack[len(stack)-1].Header.Level >= hh.Level {
+			stack = stack[:len(stack)-1]
+		}
+
+		entry := &ContentsEntry{Header: hh}
+		if len(stack) == 0 {
+			if len(contents.Entries) == 0 && hh.Level > 1 {
+				contents.Warnings = append(contents.Warnings,
+					fmt.Sprintf("Header level skipped: first header is h%d at \"%s\"",
+						hh.Level, plainText(hh.Elements)))
+			}
+			contents.Entries = append(contents.Entries, entry)
+		} else {
+			parent := stack[len(stack)-1]
+			if hh.Level > parent.Header.Level+1 {
+				contents.Warnings = append(contents.Warnings,
+					fmt.Sprintf("Header level skipped: h%d -> h%d at \"%s\"",
+						parent.Header.Level, hh.Level, plainText(hh.Elements)))
+			}
+			parent.Children = append(parent.Children, entry)
+		}
+		stack = append(stack, entry)
+	}
+	return contents
+}
+
+// The text of a header without its notes
+func entryBlock(hh *Header) *Block {
+	var withoutNotes func(elements []Element) []Element
+	withoutNotes = func(elements []Element) []Element {
+		output := []Element{}
+		for _, ee := range elements {
+			switch ee.(type) {
+			case *Text, *Emphasis:
+				output = append(output, ee)
+			case *InlineQuote:
+				iq := *ee.(*InlineQuote)
+				iq.Elements = withoutNotes(iq.Elements)
+				output = append(output, &iq)
+			}
+		}
+		return output
+	}
+	return &Block{Elements: withoutNotes(hh.Elements), Span: hh.Span}
+}
+
+func entryAnchor(hh *Header) string {
+	if hh.Id != "" {
+		return hh.Id
+	}
+	return slug(plainText(hh.Elements))
+}
+
+// ToHtml is a nav of nested lists linking to the header anchors
+func (cs Contents) ToHtml() string {
+	var list func(entries []*ContentsEntry) string
+	list = func(entries []*ContentsEntry) string {
+		output := "<ul>\n"
+		for _, ee := range entries {
+			output += "<li><a href=\"#" + escapeAttr(entryAnchor(ee.Header)) + "\">"
+			output += entryBlock(ee.Header).ToHtml() + "</a>"
+			if len(ee.Children) != 0 {
+				output += "\n" + list(ee.Children)
+			}
+			output += "</li>\n"
+		}
+		return output + "</ul>"
+	}
+
+	if len(cs.Entries) == 0 {
+		return "<nav class=\"contents\"></nav>"
+	}
+	return "<nav class=\"contents\">\n" + list(cs.Entries) + "\n</nav>"
+}
+
+// ToStrings is a Marginalia outline, a paragraph with a numbered line
+// for each header
+func (cs Contents) ToStrings() []string {
+	output := []string{}
+	var outline func(entries []*ContentsEntry, number string)
+	outline = func(entries []*ContentsEntry, number string) {
+		for ii, ee := range entries {
+			nn := number + strconv.Itoa(ii+1) + "."
+			text := strings.Join(entryBlock(ee.Header).ToStrings(), " ")
+			output = append(output, nn+" "+text+"  ")
+			outline(ee.Children, nn)
+		}
+	}
+	outline(cs.Entries, "")
+
+	if len(output) != 0 {
+		last := len(output) - 1
+		output[last] = strings.TrimRight(output[last], " ")
+	}
+	return output
+}
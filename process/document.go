@@ -2,8 +2,9 @@ package process
 
 import (
 	"errors"
-	"log"
 	"strconv"
+	"strings"
+	"unicode/utf8"
 )
 
 // Document consists of
@@ -34,18 +35,20 @@ type Element interface {
 type Collection interface {
 	ToStrings() []string
 	ToHtml() string
+	ToFlowText() string
 }
 
 type Text struct {
 	content string
+	Span
 }
 
 func (tt *Text) ToHtml() string {
-	return tt.content
+	return escapeHtml(tt.content)
 }
 
 func (tt *Text) ToText() string {
-	return tt.content
+	return escapeLiterals(markedText(tt))
 }
 
 type Emphasis struct {
@@ -77,28 +80,33 @@ func (ee *Emphasis) ToHtml() string {
 }
 
 func (ee *Emphasis) ToText() string {
+	return escapeLiterals(ee.marked())
+}
+
+func (ee *Emphasis) marked() string {
 	output := ""
 
 	if ee.Strong {
-		output += "*"
+		output += "**"
 	}
 	if ee.Em {
 		output += "_"
 	}
 
-	output += ee.Text.ToHtml()
+	output += markLiterals(ee.content)
 
 	if ee.Em {
 		output += "_"
 	}
 	if ee.Strong {
-		output += "*"
+		output += "**"
 	}
 
 	return output
 }
 
 type LineBreak struct {
+	Span
 }
 
 func (*LineBreak) ToHtml() string {
@@ -110,50 +118,54 @@ func (*LineBreak) ToText() string {
 }
 
 type Header struct {
-	Content Element
-	Level   int
-}
-
-func (hh *Header) AddElement(ee Element) {
-	hh.Content = ee
+	Block
+	Level int
+	// Id is the anchor of the header in html, if not empty
+	Id string
 }
 
 func (hh *Header) ToStrings() []string {
-	hashes := ""
-	for ii := 0; ii < hh.Level; ii++ {
-		hashes += "#"
+	lines, err := Justification{}.headerLines(hh)
+	if err != nil {
+		hashes := strings.Repeat("#", hh.Level)
+		return []string{hashes + " " + strings.Join(hh.Block.ToStrings(), " ") + " " + hashes}
 	}
-	output := hashes + " " + hh.Content.ToText() + " " + hashes
-	return []string{output}
+	return lines
 }
 
 func (hh *Header) ToHtml() string {
 	hlevel := "h" + strconv.Itoa(hh.Level)
-	inner_html := hh.Content.ToHtml()
-	return "<" + hlevel + ">" + inner_html + "</" + hlevel + ">"
+	id := ""
+	if hh.Id != "" {
+		id = " id=\"" + escapeAttr(hh.Id) + "\""
+	}
+	inner_html := hh.Block.ToHtml()
+	return "<" + hlevel + id + ">" + inner_html + "</" + hlevel + ">"
 }
 
 type Block struct {
 	Elements []Element
+	Span
 }
 
 type Note struct {
 	Elements []Element
+	Span
 }
 
+// Notes hold only Text, Emphasis and inline quotes of them. Anything
+// else is rendered as best it can be; check finds it.
 func (nn *Note) ToHtml() string {
 	output := ""
 
 	for ii, ee := range nn.Elements {
-		switch ee.(type) {
-		default:
-			log.Fatalln("Note contains non-Text or non-Emphasis type")
-		case *Text, *Emphasis:
-			if ii != 0 {
-				output += " "
-			}
-			output += ee.ToHtml()
+		if ee == nil {
+			continue
 		}
+		if ii != 0 && !joinsPrevious(ee) {
+			output += " "
+		}
+		output += ee.ToHtml()
 	}
 
 	output += ""
@@ -161,43 +173,101 @@ func (nn *Note) ToHtml() string {
 }
 
 func (nn *Note) ToText() string {
+	return escapeLiterals(noteText(nn.Elements))
+}
+
+func noteText(elements []Element) string {
 	output := ""
-	for ii, ee := range nn.Elements {
-		switch ee.(type) {
-		default:
-			log.Fatalln("Note contains non-Text or non-Emphasis type")
-		case *Text, *Emphasis:
-			if ii != 0 {
-				output += " "
+	for ii, ee := range elements {
+		if ee == nil {
+			continue
+		}
+		if ii != 0 && !joinsPrevious(ee) {
+			output += " "
+		}
+		if iq, ok := ee.(*InlineQuote); ok {
+			output += lquo + noteText(iq.Elements)
+			if iq.Citation != "" {
+				output += " " + citation + " " + iq.Citation
 			}
-			output += ee.ToText()
+			output += rquo
+			continue
 		}
+		output += markedText(ee)
 	}
 	return output
 }
 
-func (nn *Note) AddElement(ee Element) error {
+func noteElement(ee Element) bool {
 	switch ee.(type) {
-	default:
-		return errors.New("Bad type for Note")
 	case *Text, *Emphasis:
-		nn.Elements = append(nn.Elements, ee)
-		return nil
+		return true
+	case *InlineQuote:
+		for _, inner := range ee.(*InlineQuote).Elements {
+			switch inner.(type) {
+			default:
+				return false
+			case *Text, *Emphasis:
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (nn *Note) check() error {
+	for _, ee := range nn.Elements {
+		if !noteElement(ee) {
+			return errors.New("Note contains a type other than Text, Emphasis or InlineQuote")
+		}
+	}
+	return nil
+}
+
+func (nn *Note) AddElement(ee Element) error {
+	if !noteElement(ee) {
+		return errors.New("Bad type for Note")
 	}
+	nn.Elements = append(nn.Elements, ee)
+	return nil
 }
 
 func (pp *Block) AddElement(ee Element) {
 	pp.Elements = append(pp.Elements, ee)
 }
 
+// The text of an element with its literal delimiters and backslashes
+// marked, to be escaped once the line it is on is known
+func markedText(ee Element) string {
+	switch ee.(type) {
+	case *Text:
+		return markLiterals(ee.(*Text).content)
+	case *Emphasis:
+		return ee.(*Emphasis).marked()
+	}
+	return ee.ToText()
+}
+
+// Text starting with closing punctuation follows the element before it
+// without a space
+func joinsPrevious(ee Element) bool {
+	tt := textOf(ee)
+	if tt == nil {
+		return false
+	}
+	rr, _ := utf8.DecodeRuneInString(tt.content)
+	return strings.ContainsRune(".,;:!?)]}·»’…", rr)
+}
+
 func (pp *Block) ToHtml() string {
 	output := ""
 	spaceNeeded := false
 
 	for _, ee := range pp.Elements {
 		switch ee.(type) {
+		case nil:
 		default:
-			if spaceNeeded {
+			if spaceNeeded && !joinsPrevious(ee) {
 				output += " "
 			}
 			output += ee.ToHtml()
@@ -210,6 +280,15 @@ func (pp *Block) ToHtml() string {
 			output += dagger + " "
 			output += ee.ToHtml()
 			spaceNeeded = true
+		case *footnoteRef:
+			output += ee.ToHtml()
+			spaceNeeded = true
+		case *marginNote:
+			if ee.(*marginNote).class == "leftnote" && spaceNeeded {
+				output += " "
+			}
+			output += ee.ToHtml()
+			spaceNeeded = true
 		case *Leftnote:
 			output += " "
 			output += ee.ToHtml()
@@ -226,18 +305,32 @@ func (pp *Block) ToHtml() string {
 	return output
 }
 
+// ToStrings is the block in canonical Marginalia form: laid out
+// unwrapped, with each sidenote on one line beside its marker and each
+// footnote after the line holding its dagger. Importing it gives back
+// the same block.
 func (pp *Block) ToStrings() []string {
+	lines, err := Justification{}.paragraphLines(pp, "", "")
+	if err != nil {
+		return pp.looseStrings()
+	}
+	return lines
+}
+
+// Every element as text, notes on lines of their own, for blocks that
+// cannot be laid out
+func (pp *Block) looseStrings() []string {
 	output := []string{""}
 	line := &output[0]
 
 	spaceNeeded := false
 
-	for _, ee := range pp.Elements {
+	var addElement func(ee Element)
+	addElement = func(ee Element) {
 		switch ee.(type) {
+		case nil:
 		default:
-			log.Fatalln("Bad type in ToText")
-		case *Text, *Emphasis:
-			if spaceNeeded {
+			if spaceNeeded && !joinsPrevious(ee) {
 				*line += " "
 			}
 			*line += ee.ToText()
@@ -268,14 +361,27 @@ func (pp *Block) ToStrings() []string {
 			output = append(output, "")
 			line = &output[len(output)-1]
 			spaceNeeded = false
-                case *InlineQuote:
-                        if spaceNeeded {
-                                *line += " "
-                        }
-                        *line += lquo + ee.ToText() + rquo
-                        spaceNeeded = true
+		case *InlineQuote:
+			iq := ee.(*InlineQuote)
+			if spaceNeeded {
+				*line += " "
+			}
+			*line += lquo
+			spaceNeeded = false
+			for _, inner := range iq.Elements {
+				addElement(inner)
+			}
+			if iq.Citation != "" {
+				*line += " ‖ " + iq.Citation
+			}
+			*line += rquo
+			spaceNeeded = true
 		}
 	}
+
+	for _, ee := range pp.Elements {
+		addElement(ee)
+	}
 	return output
 }
 
@@ -327,6 +433,7 @@ func (rr *Rightnote) ToHtml() string {
 type BlockQuote struct {
 	Paragraphs []Paragraph
 	Citation   string
+	Span
 }
 
 func (bb *BlockQuote) AddParagraph(para Paragraph) {
@@ -343,64 +450,166 @@ func (bb *BlockQuote) ToHtml() string {
 	}
 	cite := ""
 	if bb.Citation != "" {
-		cite = " cite=\"" + bb.Citation + "\""
+		cite = " cite=\"" + escapeAttr(bb.Citation) + "\""
 	}
 	return "<blockquote" + cite + ">\n" + inner_html + "\n</blockquote>"
 }
 
+// ToStrings is the quotation in canonical Marginalia form, indented,
+// between curly quotes and followed by its citation
 func (bb *BlockQuote) ToStrings() []string {
-	var strings []string
+	lines, err := Justification{}.quoteLines(bb)
+	if err == nil {
+		return lines
+	}
+
+	output := []string{}
 	for ii, pp := range bb.Paragraphs {
 		if ii != 0 {
-			strings = append(strings, "")
+			output = append(output, quoteIndent)
 		}
-		for _, ss := range pp.ToStrings() {
-			strings = append(strings, ss)
+		for _, ss := range pp.looseStrings() {
+			output = append(output, quoteIndent+ss)
 		}
 	}
-
-	output := []string{}
-	for _, ss := range strings {
-		//indent 4
-		output = append(output, "    "+ss)
-	}
-
 	if bb.Citation != "" {
-		output = append(output, "    ")
-		output = append(output, "    "+bb.Citation)
+		output = append(output, quoteIndent)
+		output = append(output, quoteIndent+bb.Citation)
 	}
-
 	return output
 }
 
+// Inline quotes can hold notes and line breaks as well as text
 type InlineQuote struct {
 	Note
 	Citation string
 }
 
+func (iq *InlineQuote) AddElement(ee Element) error {
+	switch ee.(type) {
+	default:
+		return errors.New("Bad type for InlineQuote")
+	case *Text, *Emphasis, *LineBreak, *Footnote, *Leftnote, *Rightnote:
+		iq.Elements = append(iq.Elements, ee)
+		return nil
+	}
+}
+
 func (iq *InlineQuote) ToHtml() string {
 	cite := ""
 	if iq.Citation != "" {
-		cite = " cite=\"" + iq.Citation + "\""
+		cite = " cite=\"" + escapeAttr(iq.Citation) + "\""
 	}
 	output := "<q" + cite + ">"
-	output += iq.Note.ToHtml()
+	output += (&Block{Elements: iq.Elements}).ToHtml()
 	output += "</q>"
 	return output
 }
 
+// Notes in the quote are reduced to their markers
 func (iq *InlineQuote) ToText() string {
 	cite := ""
 	if iq.Citation != "" {
 		cite = " ‖ " + iq.Citation
 	}
 
-        output := ""
-	output += iq.Note.ToText()
+	output := ""
+	leftMarker := ""
+	for _, ee := range iq.Elements {
+		switch ee.(type) {
+		default:
+			if output != "" && (leftMarker != "" || !joinsPrevious(ee)) {
+				output += " "
+			}
+			output += leftMarker + ee.ToText()
+			leftMarker = ""
+		case *LineBreak:
+		case *Footnote:
+			output += dagger
+		case *Rightnote:
+			output += ring
+		case *Leftnote:
+			leftMarker += dot
+		}
+	}
 	output += cite + ""
 	return output
 }
 
+// Check that the elements of a block are ones its renderers know,
+// for callers that need to hear about a bad tree rather than get
+// whatever it renders as
+func (pp *Block) check() error {
+	for _, ee := range pp.Elements {
+		switch ee.(type) {
+		default:
+			return errors.New("Bad type in Block")
+		case *Text, *Emphasis, *LineBreak:
+		case *Footnote:
+			if err := ee.(*Footnote).check(); err != nil {
+				return err
+			}
+		case *Leftnote:
+			if err := ee.(*Leftnote).check(); err != nil {
+				return err
+			}
+		case *Rightnote:
+			if err := ee.(*Rightnote).check(); err != nil {
+				return err
+			}
+		case *InlineQuote:
+			for _, inner := range ee.(*InlineQuote).Elements {
+				switch inner.(type) {
+				case *InlineQuote:
+					return errors.New("Bad type for InlineQuote")
+				}
+			}
+			if err := (&Block{Elements: ee.(*InlineQuote).Elements}).check(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Check reports an error if the collection holds elements that it
+// cannot render
+func Check(cc Collection) error {
+	switch cc.(type) {
+	default:
+		return errors.New("Bad type of Collection")
+	case *Header:
+		return cc.(*Header).check()
+	case *Paragraph:
+		return cc.(*Paragraph).check()
+	case *BlockQuote:
+		for _, pp := range cc.(*BlockQuote).Paragraphs {
+			if err := pp.check(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CheckedHtml is ToHtml, returning an error for a collection that
+// cannot be rendered
+func CheckedHtml(cc Collection) (string, error) {
+	if err := Check(cc); err != nil {
+		return "", err
+	}
+	return cc.ToHtml(), nil
+}
+
+// CheckedStrings is ToStrings, returning an error for a collection that
+// cannot be rendered
+func CheckedStrings(cc Collection) ([]string, error) {
+	if err := Check(cc); err != nil {
+		return []string{}, err
+	}
+	return cc.ToStrings(), nil
+}
+
 func (pp *Paragraph) Empty() bool {
         return len(pp.Elements) == 0
 }
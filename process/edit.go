@@ -0,0 +1,331 @@
+package process
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Documents can be built and edited in Go as well as read. Notes hold
+// only Text, Emphasis and inline quotes of them, as Note.AddElement
+// requires, and an inline quote holds no inline quote; edits that would
+// break either are refused. Words are counted in the main text of a
+// block, including inline quotes but not notes, from 1.
+
+func NewText(content string) *Text {
+	return &Text{content: content}
+}
+
+func NewEmphasis(content string, em, strong bool) *Emphasis {
+	return &Emphasis{Text{content: content}, em, strong}
+}
+
+func NewFootnote(elements ...Element) (*Footnote, error) {
+	ff := &Footnote{}
+	for _, ee := range elements {
+		if err := ff.AddElement(ee); err != nil {
+			return nil, err
+		}
+	}
+	return ff, nil
+}
+
+func NewLeftnote(elements ...Element) (*Leftnote, error) {
+	ll := &Leftnote{}
+	for _, ee := range elements {
+		if err := ll.AddElement(ee); err != nil {
+			return nil, err
+		}
+	}
+	return ll, nil
+}
+
+func NewRightnote(elements ...Element) (*Rightnote, error) {
+	rr := &Rightnote{}
+	for _, ee := range elements {
+		if err := rr.AddElement(ee); err != nil {
+			return nil, err
+		}
+	}
+	return rr, nil
+}
+
+var wordPattern = regexp.MustCompile(`\S+`)
+
+// Where an element is in a block: the list holding it, which is the
+// elements of an inline quote inside one, and its index there
+type elementPlace struct {
+	elements *[]Element
+	index    int
+	inQuote  bool
+}
+
+func (ep elementPlace) element() Element {
+	return (*ep.elements)[ep.index]
+}
+
+// Call fn on the elements of a block in order, those of an inline quote
+// after the quote, until it returns false
+func eachPlace(elements *[]Element, inQuote bool, fn func(ep elementPlace) bool) bool {
+	for ii := range *elements {
+		ep := elementPlace{elements, ii, inQuote}
+		if !fn(ep) {
+			return false
+		}
+		if iq, ok := ep.element().(*InlineQuote); ok {
+			if !eachPlace(&iq.Elements, true, fn) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func wordRanges(ee Element) [][]int {
+	tt := textOf(ee)
+	if tt == nil {
+		return [][]int{}
+	}
+	return wordPattern.FindAllStringIndex(tt.content, -1)
+}
+
+// WordCount is the number of words in the main text of a block
+func (pp *Block) WordCount() int {
+	count := 0
+	eachPlace(&pp.Elements, false, func(ep elementPlace) bool {
+		count += len(wordRanges(ep.element()))
+		return true
+	})
+	return count
+}
+
+// The element holding word nn, and the byte range of the word in it
+func (pp *Block) findWord(nn int) (elementPlace, []int, error) {
+	var place elementPlace
+	var word []int
+	if nn < 1 {
+		return place, word, errors.New("No word " + strconv.Itoa(nn) + " in block")
+	}
+	count := 0
+	eachPlace(&pp.Elements, false, func(ep elementPlace) bool {
+		words := wordRanges(ep.element())
+		if count+len(words) >= nn {
+			place, word = ep, words[nn-count-1]
+			return false
+		}
+		count += len(words)
+		return true
+	})
+	if word == nil {
+		return place, word, errors.New("No word " + strconv.Itoa(nn) + " in block")
+	}
+	return place, word, nil
+}
+
+func (pp *Block) find(target Element) (elementPlace, int, error) {
+	var place elementPlace
+	found := false
+	words := 0
+	eachPlace(&pp.Elements, false, func(ep elementPlace) bool {
+		if ep.element() == target {
+			place, found = ep, true
+			return false
+		}
+		words += len(wordRanges(ep.element()))
+		return true
+	})
+	if !found {
+		return place, 0, errors.New("Element not in block")
+	}
+	return place, words, nil
+}
+
+// Where byte at of the content of a text was read from. Only text read
+// unchanged from one line of the source can be told.
+func (tt *Text) sourceAt(at int) (Position, bool) {
+	if tt.Start.Line == 0 || tt.End.Line != tt.Start.Line || tt.End.Offset-tt.Start.Offset != len(tt.content) {
+		return Position{}, false
+	}
+	return Position{tt.Start.Line, tt.Start.Column + utf8.RuneCountInString(tt.content[:at]), tt.Start.Offset + at}, true
+}
+
+// Split the text at a place at byte at, returning the index between the
+// two halves. Each half has the part of the span of the text it was read
+// from, or the whole span when that cannot be told.
+func splitText(ep elementPlace, at int) int {
+	tt := textOf(ep.element())
+	head := strings.TrimRight(tt.content[:at], " ")
+	tail := strings.TrimLeft(tt.content[at:], " ")
+	if head == "" {
+		return ep.index
+	}
+	if tail == "" {
+		return ep.index + 1
+	}
+
+	first, rest := tt.Span, tt.Span
+	if end, ok := tt.sourceAt(len(head)); ok {
+		first.End = end
+		rest.Start, _ = tt.sourceAt(len(tt.content) - len(tail))
+	}
+	var second Element
+	switch ep.element().(type) {
+	case *Text:
+		second = &Text{tail, rest}
+	case *Emphasis:
+		ee := ep.element().(*Emphasis)
+		second = &Emphasis{Text{tail, rest}, ee.Em, ee.Strong}
+	}
+	tt.content = head
+	tt.Span = first
+	insertElement(ep.elements, ep.index+1, second)
+	return ep.index + 1
+}
+
+func insertElement(elements *[]Element, ii int, ee Element) {
+	*elements = append(*elements, nil)
+	copy((*elements)[ii+1:], (*elements)[ii:])
+	(*elements)[ii] = ee
+}
+
+// Whether an element may go in a block, or in an inline quote in one
+func checkPlaced(ee Element, inQuote bool) error {
+	if inQuote {
+		if err := (&InlineQuote{}).AddElement(ee); err != nil {
+			return err
+		}
+	}
+	return (&Block{Elements: []Element{ee}}).check()
+}
+
+// InsertAfterWord puts an element, such as a footnote or a right
+// sidenote, just after word nn of the block
+func (pp *Block) InsertAfterWord(nn int, ee Element) error {
+	place, word, err := pp.findWord(nn)
+	if err != nil {
+		return err
+	}
+	if err = checkPlaced(ee, place.inQuote); err != nil {
+		return err
+	}
+	insertElement(place.elements, splitText(place, word[1]), ee)
+	return nil
+}
+
+// InsertBeforeWord puts an element, such as a left sidenote, just
+// before word nn of the block
+func (pp *Block) InsertBeforeWord(nn int, ee Element) error {
+	place, word, err := pp.findWord(nn)
+	if err != nil {
+		return err
+	}
+	if err = checkPlaced(ee, place.inQuote); err != nil {
+		return err
+	}
+	insertElement(place.elements, splitText(place, word[0]), ee)
+	return nil
+}
+
+// Remove takes an element out of the block
+func (pp *Block) Remove(ee Element) error {
+	place, _, err := pp.find(ee)
+	if err != nil {
+		return err
+	}
+	*place.elements = append((*place.elements)[:place.index], (*place.elements)[place.index+1:]...)
+	return nil
+}
+
+// Replace puts an element in the place of another
+func (pp *Block) Replace(old, ee Element) error {
+	place, _, err := pp.find(old)
+	if err != nil {
+		return err
+	}
+	if err = checkPlaced(ee, place.inQuote); err != nil {
+		return err
+	}
+	(*place.elements)[place.index] = ee
+	return nil
+}
+
+// MoveToRight puts a left sidenote in the right channel, after the word
+// it marked. The block is left as it was if the note cannot go there.
+func (pp *Block) MoveToRight(ll *Leftnote) (*Rightnote, error) {
+	place, words, err := pp.find(ll)
+	if err != nil {
+		return nil, err
+	}
+	rr := &Rightnote{ll.Note}
+	if words == pp.WordCount() {
+		(*place.elements)[place.index] = rr
+		return rr, nil
+	}
+	if err = pp.Remove(ll); err != nil {
+		return nil, err
+	}
+	if err = pp.InsertAfterWord(words+1, rr); err != nil {
+		insertElement(place.elements, place.index, ll)
+		return nil, err
+	}
+	return rr, nil
+}
+
+// MoveToLeft puts a right sidenote in the left channel, before the word
+// it marked. The block is left as it was if the note cannot go there.
+func (pp *Block) MoveToLeft(rr *Rightnote) (*Leftnote, error) {
+	place, words, err := pp.find(rr)
+	if err != nil {
+		return nil, err
+	}
+	ll := &Leftnote{rr.Note}
+	if words == 0 {
+		(*place.elements)[place.index] = ll
+		return ll, nil
+	}
+	if err = pp.Remove(rr); err != nil {
+		return nil, err
+	}
+	if err = pp.InsertBeforeWord(words, ll); err != nil {
+		insertElement(place.elements, place.index, rr)
+		return nil, err
+	}
+	return ll, nil
+}
+
+// SplitAt ends the paragraph at one of its line breaks, returning a new
+// paragraph with what followed the break
+func (pp *Paragraph) SplitAt(lb *LineBreak) (*Paragraph, error) {
+	for ii, ee := range pp.Elements {
+		if ee != lb {
+			continue
+		}
+		rest := &Paragraph{}
+		rest.Elements = append([]Element{}, pp.Elements[ii+1:]...)
+		rest.Span = Span{lb.End, pp.End}
+		pp.Elements = pp.Elements[:ii]
+		pp.End = lb.Start
+		return rest, nil
+	}
+	return nil, errors.New("Line break not in paragraph")
+}
+
+// Merge adds the paragraphs of another quotation to the end of this one.
+// Only one of them may have a citation.
+func (bb *BlockQuote) Merge(other *BlockQuote) error {
+	if bb.Citation != "" && other.Citation != "" {
+		return errors.New("Both quotations have citations")
+	}
+	if other.Citation != "" {
+		bb.Citation = other.Citation
+	}
+	bb.Paragraphs = append(bb.Paragraphs, other.Paragraphs...)
+	if bb.Start.Line != 0 && other.End.Line != 0 && other.End.Offset >= bb.End.Offset {
+		bb.End = other.End
+	} else {
+		bb.Span = Span{}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package process
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrorCode names the kind of problem a ParseError reports
+type ErrorCode string
+
+const (
+	ErrHeaderLevels        ErrorCode = "header-levels"
+	ErrUnplacedFootnote    ErrorCode = "unplaced-footnote"
+	ErrMismatchedSidenotes ErrorCode = "mismatched-sidenotes"
+	ErrEmphasisInQuote     ErrorCode = "emphasis-crosses-quote"
+	ErrBadNote             ErrorCode = "bad-note"
+	ErrUnexpectedType      ErrorCode = "unexpected-type"
+	ErrUnconsumedLines     ErrorCode = "unconsumed-lines"
+	ErrNotNormalized       ErrorCode = "not-nfc"
+	ErrInvalidEncoding     ErrorCode = "invalid-utf8"
+	ErrControlCharacter    ErrorCode = "control-character"
+	ErrTab                 ErrorCode = "tab"
+	ErrMisplacedMarkup     ErrorCode = "misplaced-markup"
+	ErrUnclosedEmphasis    ErrorCode = "unclosed-emphasis"
+	ErrNotCanonical        ErrorCode = "not-canonical"
+)
+
+// Longest snippet of source kept with an error, in runes
+const snippetLength = 40
+
+// ParseError is a problem found while reading Marginalia text, with
+// where in the source it was found
+type ParseError struct {
+	Position
+	Code    ErrorCode
+	Message string
+	Snippet string
+}
+
+func (pe *ParseError) Error() string {
+	if pe.Line == 0 {
+		return pe.Message
+	}
+	return fmt.Sprintf("%d:%d: %s", pe.Line, pe.Column, pe.Message)
+}
+
+func newParseError(code ErrorCode, message string, at sourceText) *ParseError {
+	snippet := []rune(strings.Trim(at.text, " "))
+	if len(snippet) > snippetLength {
+		snippet = snippet[:snippetLength]
+	}
+	return &ParseError{Position{Offset: at.offset()}, code, message, string(snippet)}
+}
+
+// ErrorList is every error found in one Import
+type ErrorList []*ParseError
+
+func (el ErrorList) Error() string {
+	messages := []string{}
+	for _, ee := range el {
+		messages = append(messages, ee.Error())
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Add an error, or the errors of a list, to the list
+func (el *ErrorList) add(err error) {
+	switch ee := err.(type) {
+	case nil:
+	case ErrorList:
+		*el = append(*el, ee...)
+	case *ParseError:
+		*el = append(*el, ee)
+	default:
+		*el = append(*el, &ParseError{Position{Offset: -1}, ErrUnexpectedType, ee.Error(), ""})
+	}
+}
+
+// The list as an error, or nil when it is empty
+func (el ErrorList) err() error {
+	if len(el) == 0 {
+		return nil
+	}
+	return el
+}
+
+// Fill in lines and columns from the source offsets, and put the errors
+// in the order they appear in the source
+func (el ErrorList) locate(input string) {
+	index := newLineIndex(input)
+	for _, ee := range el {
+		ee.Position = index.position(ee.Offset)
+	}
+	sort.SliceStable(el, func(ii, jj int) bool {
+		if el[ii].Line == 0 || el[jj].Line == 0 {
+			return el[jj].Line == 0 && el[ii].Line != 0
+		}
+		return el[ii].Offset < el[jj].Offset
+	})
+}
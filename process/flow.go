@@ -0,0 +1,191 @@
+package process
+
+import (
+	"io"
+	"strconv"
+	"strings"
+)
+
+// FlowOptions controls the flow text of a document
+type FlowOptions struct {
+	// NoteNumbers marks each note with a bracketed number and gathers
+	// the notes at the end. Otherwise notes are left out.
+	NoteNumbers bool
+}
+
+// The notes taken out of the reading line. A nil flowNotes drops them.
+type flowNotes struct {
+	notes []string
+}
+
+// The mark a note leaves in the text
+func (fn *flowNotes) mark(nn *Note) string {
+	if fn == nil {
+		return ""
+	}
+	fn.notes = append(fn.notes, fn.text(nn.Elements))
+	return "[" + strconv.Itoa(len(fn.notes)) + "]"
+}
+
+// Elements as plain text, without emphasis or escapes
+func (fn *flowNotes) text(elements []Element) string {
+	output := ""
+	spaceNeeded := false
+
+	for _, ee := range elements {
+		switch ee.(type) {
+		case nil:
+		default:
+			if spaceNeeded {
+				output += " "
+			}
+			output += ee.ToText()
+			spaceNeeded = true
+		case *Text:
+			if spaceNeeded && !joinsPrevious(ee) {
+				output += " "
+			}
+			output += ee.(*Text).content
+			spaceNeeded = true
+		case *Emphasis:
+			if spaceNeeded && !joinsPrevious(ee) {
+				output += " "
+			}
+			output += ee.(*Emphasis).content
+			spaceNeeded = true
+		case *LineBreak:
+			output += "\n"
+			spaceNeeded = false
+		case *Footnote:
+			output += fn.mark(&ee.(*Footnote).Note)
+		case *Rightnote:
+			output += fn.mark(&ee.(*Rightnote).Note)
+		case *Leftnote:
+			mark := fn.mark(&ee.(*Leftnote).Note)
+			if mark != "" {
+				if spaceNeeded {
+					output += " "
+				}
+				output += mark
+				spaceNeeded = true
+			}
+		case *InlineQuote:
+			iq := ee.(*InlineQuote)
+			if spaceNeeded {
+				output += " "
+			}
+			output += lquo + fn.text(iq.Elements) + rquo
+			if iq.Citation != "" {
+				output += " (" + iq.Citation + ")"
+			}
+			spaceNeeded = true
+		}
+	}
+	return output
+}
+
+func (fn *flowNotes) collection(cc Collection) string {
+	switch cc.(type) {
+	default:
+		return cc.ToFlowText()
+	case *Header:
+		return fn.text(cc.(*Header).Elements)
+	case *Paragraph:
+		return fn.text(cc.(*Paragraph).Elements)
+	case *BlockQuote:
+		bb := cc.(*BlockQuote)
+		paragraphs := []string{}
+		for _, pp := range bb.Paragraphs {
+			paragraphs = append(paragraphs, fn.text(pp.Elements))
+		}
+		if bb.Citation != "" {
+			paragraphs = append(paragraphs, bb.Citation)
+		}
+		lines := strings.Split(strings.Join(paragraphs, "\n\n"), "\n")
+		for ii := range lines {
+			if lines[ii] != "" {
+				lines[ii] = "    " + lines[ii]
+			}
+		}
+		return strings.Join(lines, "\n")
+	}
+}
+
+// ToFlowText is the header text alone
+func (hh *Header) ToFlowText() string {
+	return (*flowNotes)(nil).collection(hh)
+}
+
+// ToFlowText is the paragraph as one line, without its notes. Line
+// breaks are kept.
+func (pp *Paragraph) ToFlowText() string {
+	return (*flowNotes)(nil).collection(pp)
+}
+
+// ToFlowText is the quoted paragraphs and the citation, indented,
+// without their notes
+func (bb *BlockQuote) ToFlowText() string {
+	return (*flowNotes)(nil).collection(bb)
+}
+
+func (es *endnoteSection) ToFlowText() string {
+	output := []string{}
+	for _, nn := range es.notes {
+		output = append(output, nn.mark+" "+(*flowNotes)(nil).text(nn.note.Elements))
+	}
+	return strings.Join(output, "\n")
+}
+
+// FlowWriter writes the flow text of a document a collection at a time,
+// the same text as FlowText. Numbered notes are kept until Close.
+type FlowWriter struct {
+	writer io.Writer
+	notes  *flowNotes
+	count  int
+}
+
+func NewFlowWriter(ww io.Writer, opts FlowOptions) *FlowWriter {
+	fw := &FlowWriter{writer: ww}
+	if opts.NoteNumbers {
+		fw.notes = &flowNotes{}
+	}
+	return fw
+}
+
+func (fw *FlowWriter) paragraph(text string) error {
+	if fw.count != 0 {
+		text = "\n\n" + text
+	}
+	fw.count++
+	_, err := io.WriteString(fw.writer, text)
+	return err
+}
+
+func (fw *FlowWriter) Write(cc Collection) error {
+	return fw.paragraph(fw.notes.collection(cc))
+}
+
+// Close writes the numbered notes, with no newline after them
+func (fw *FlowWriter) Close() error {
+	if fw.notes == nil || len(fw.notes.notes) == 0 {
+		return nil
+	}
+	gathered := []string{}
+	for ii, nn := range fw.notes.notes {
+		gathered = append(gathered, "["+strconv.Itoa(ii+1)+"] "+nn)
+	}
+	return fw.paragraph(strings.Join(gathered, "\n"))
+}
+
+// FlowText is the copy and paste format of a document: the flow channel
+// alone, as continuous paragraphs between blank lines, for pasting into
+// email or a word processor.
+func FlowText(coll []Collection, opts FlowOptions) string {
+	output := strings.Builder{}
+	fw := NewFlowWriter(&output, opts)
+	for _, cc := range coll {
+		fw.Write(cc)
+	}
+	fw.Close()
+	return output.String()
+}
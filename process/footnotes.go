@@ -0,0 +1,153 @@
+package process
+
+import (
+	"strconv"
+	"strings"
+)
+
+// FootnoteStyle sets how footnotes are marked in html
+type FootnoteStyle int
+
+const (
+	// Footnotes follow their dagger in the text
+	InlineFootnotes FootnoteStyle = iota
+	// Footnotes are numbered and gathered into endnotes
+	NumberedFootnotes
+	// Footnotes are marked † ‡ § ‖ ¶, then †† ‡‡ and so on, and
+	// gathered into endnotes
+	SymbolFootnotes
+)
+
+// EndnotePlacement sets where gathered footnotes go
+type EndnotePlacement int
+
+const (
+	// At the end of the document
+	DocumentEndnotes EndnotePlacement = iota
+	// At the end of each chapter, before the next header
+	ChapterEndnotes
+)
+
+var footnoteSymbols = []string{"†", "‡", "§", "‖", "¶"}
+
+// The reference a gathered footnote leaves in the text
+type footnoteRef struct {
+	id   int
+	mark string
+}
+
+func (fr *footnoteRef) ToHtml() string {
+	id := strconv.Itoa(fr.id)
+	return "<sup class=\"footnote-ref\" id=\"fnref-" + id + "\"><a href=\"#fn-" + id + "\">" +
+		escapeHtml(fr.mark) + "</a></sup>"
+}
+
+func (fr *footnoteRef) ToText() string {
+	return fr.mark
+}
+
+type endnote struct {
+	footnoteRef
+	note *Footnote
+}
+
+// Footnotes gathered at the end of a chapter or document, each linking
+// back to its reference
+type endnoteSection struct {
+	notes []endnote
+}
+
+func (es *endnoteSection) ToHtml() string {
+	output := "<section class=\"footnotes\">\n"
+	for _, nn := range es.notes {
+		id := strconv.Itoa(nn.id)
+		output += "<p id=\"fn-" + id + "\"><a class=\"footnote-back\" href=\"#fnref-" + id + "\">"
+		output += escapeHtml(nn.mark) + "</a> " + nn.note.Note.ToHtml() + "</p>\n"
+	}
+	return output + "</section>"
+}
+
+func (es *endnoteSection) ToStrings() []string {
+	output := []string{}
+	for _, nn := range es.notes {
+		output = append(output, nn.mark+" "+nn.note.Note.ToText())
+	}
+	return output
+}
+
+// Replace the footnotes of a document with references, gathering them
+// into endnote sections. The collections given are not changed.
+func gatherFootnotes(coll []Collection, opts HtmlOptions) []Collection {
+	if opts.Footnotes == InlineFootnotes {
+		return coll
+	}
+
+	output := []Collection{}
+	section := &endnoteSection{}
+	count := 0
+
+	addSection := func() {
+		if len(section.notes) != 0 {
+			output = append(output, section)
+			section = &endnoteSection{}
+		}
+	}
+
+	mark := func(nn int) string {
+		if opts.Footnotes == SymbolFootnotes {
+			symbol := footnoteSymbols[nn%len(footnoteSymbols)]
+			return strings.Repeat(symbol, nn/len(footnoteSymbols)+1)
+		}
+		return strconv.Itoa(nn + 1)
+	}
+
+	var replace func(elements []Element) []Element
+	replace = func(elements []Element) []Element {
+		replaced := []Element{}
+		for _, ee := range elements {
+			switch ee.(type) {
+			default:
+				replaced = append(replaced, ee)
+			case *Footnote:
+				count++
+				ref := footnoteRef{count, mark(len(section.notes))}
+				section.notes = append(section.notes, endnote{ref, ee.(*Footnote)})
+				replaced = append(replaced, &ref)
+			case *InlineQuote:
+				iq := *ee.(*InlineQuote)
+				iq.Elements = replace(iq.Elements)
+				replaced = append(replaced, &iq)
+			}
+		}
+		return replaced
+	}
+
+	for _, cc := range coll {
+		switch cc.(type) {
+		default:
+			output = append(output, cc)
+		case *Header:
+			if opts.Endnotes == ChapterEndnotes {
+				addSection()
+			}
+			hh := *cc.(*Header)
+			hh.Elements = replace(hh.Elements)
+			output = append(output, &hh)
+		case *Paragraph:
+			pp := *cc.(*Paragraph)
+			pp.Elements = replace(pp.Elements)
+			output = append(output, &pp)
+		case *BlockQuote:
+			bq := *cc.(*BlockQuote)
+			bq.Paragraphs = []Paragraph{}
+			for _, pp := range cc.(*BlockQuote).Paragraphs {
+				pp.Elements = replace(pp.Elements)
+				bq.Paragraphs = append(bq.Paragraphs, pp)
+			}
+			output = append(output, &bq)
+		}
+	}
+	addSection()
+
+	return output
+}
@@ -1,7 +1,170 @@
 package process
 
+import (
+	_ "embed"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// HtmlOptions controls the document wrapped around converted text
+type HtmlOptions struct {
+	// Theme is linked from the document head when not empty, before
+	// Stylesheet. It is meant for ThemeStylesheet written to a file.
+	Theme string
+	// Stylesheet is linked from the document head when not empty
+	Stylesheet string
+	// Footnotes sets how footnotes are marked, and whether they are
+	// gathered into endnotes
+	Footnotes FootnoteStyle
+	// Endnotes sets where gathered footnotes go
+	Endnotes EndnotePlacement
+	// Profile sets how notes are laid out
+	Profile HtmlProfile
+}
+
+// ThemeStylesheet is the default css for converted documents
+//
+//go:embed theme.css
+var ThemeStylesheet string
+
+var htmlEscaper = strings.NewReplacer(
+	"&", "&amp;",
+	"<", "&lt;",
+	">", "&gt;",
+)
+
+var attrEscaper = strings.NewReplacer(
+	"&", "&amp;",
+	"<", "&lt;",
+	">", "&gt;",
+	"\"", "&quot;",
+	"'", "&#39;",
+)
+
+var numericEntity = regexp.MustCompile("&#([0-9]+|[xX][0-9a-fA-F]+);")
+
+// A numeric character reference is kept if it names a character that
+// may appear in a document
+func validEntity(ref string) bool {
+	digits := ref[2 : len(ref)-1]
+	base := 10
+	if digits[0] == 'x' || digits[0] == 'X' {
+		digits = digits[1:]
+		base = 16
+	}
+	code, err := strconv.ParseInt(digits, base, 32)
+	if err != nil || code == 0 || !utf8.ValidRune(rune(code)) {
+		return false
+	}
+	return code >= 0x20 || code == '\t' || code == '\n' || code == '\r'
+}
+
+// Escape with replacer, leaving alone the numeric character references
+// already in the source, such as &#8212;
+func escapeEntities(ss string, replacer *strings.Replacer) string {
+	output := ""
+	last := 0
+	for _, loc := range numericEntity.FindAllStringIndex(ss, -1) {
+		if !validEntity(ss[loc[0]:loc[1]]) {
+			continue
+		}
+		output += replacer.Replace(ss[last:loc[0]]) + ss[loc[0]:loc[1]]
+		last = loc[1]
+	}
+	return output + replacer.Replace(ss[last:])
+}
+
+// Escape text for html content
+func escapeHtml(ss string) string {
+	return escapeEntities(ss, htmlEscaper)
+}
+
+// Escape text for a quoted html attribute
+func escapeAttr(ss string) string {
+	return escapeEntities(ss, attrEscaper)
+}
+
 // Convert text -> html
 func Convert(input string) (string, error) {
-        ss := input
-        return ss, nil
+	return ConvertHtml(input, HtmlOptions{})
+}
+
+// ConvertHtml text -> html, with options for the document head
+func ConvertHtml(input string, opts HtmlOptions) (string, error) {
+	coll, err := Import(input)
+	if err != nil {
+		return "", err
+	}
+	return HtmlDocument(coll, opts)
+}
+
+// Text and quotations without markup or notes
+func plainText(elements []Element) string {
+	output := ""
+	for _, ee := range elements {
+		word := ""
+		switch ee.(type) {
+		default:
+			continue
+		case *Text:
+			word = ee.(*Text).content
+		case *Emphasis:
+			word = ee.(*Emphasis).content
+		case *InlineQuote:
+			word = lquo + plainText(ee.(*InlineQuote).Elements) + rquo
+		}
+		if output != "" && !joinsPrevious(ee) {
+			output += " "
+		}
+		output += word
+	}
+	return output
+}
+
+// The text of the first level 1 header, without markup
+func documentTitle(coll []Collection) string {
+	for _, cc := range coll {
+		if hh, ok := cc.(*Header); ok && hh.Level == 1 {
+			return plainText(hh.Elements)
+		}
+	}
+	return ""
+}
+
+// HtmlDocument wraps the html of each collection in an HTML5 document
+func HtmlDocument(coll []Collection, opts HtmlOptions) (string, error) {
+	output := strings.Builder{}
+	output.WriteString("<!DOCTYPE html>\n")
+	output.WriteString("<html>\n")
+	output.WriteString("<head>\n")
+	output.WriteString("<meta charset=\"utf-8\">\n")
+	output.WriteString("<title>" + escapeHtml(documentTitle(coll)) + "</title>\n")
+	if opts.Theme != "" {
+		output.WriteString("<link rel=\"stylesheet\" href=\"" + escapeAttr(opts.Theme) + "\">\n")
+	}
+	if opts.Profile == MarginProfile {
+		output.WriteString("<style>\n" + MarginStylesheet + "</style>\n")
+	}
+	if opts.Stylesheet != "" {
+		output.WriteString("<link rel=\"stylesheet\" href=\"" + escapeAttr(opts.Stylesheet) + "\">\n")
+	}
+	output.WriteString("</head>\n")
+	if opts.Profile == MarginProfile {
+		output.WriteString("<body class=\"margins\">\n")
+	} else {
+		output.WriteString("<body>\n")
+	}
+	for _, cc := range coll {
+		if err := Check(cc); err != nil {
+			return "", err
+		}
+	}
+	for _, cc := range placeMarginNotes(gatherFootnotes(coll, opts), opts) {
+		output.WriteString(cc.ToHtml() + "\n")
+	}
+	output.WriteString("</body>\n")
+	output.WriteString("</html>")
+	return output.String(), nil
 }
@@ -1,14 +1,18 @@
 package process
 
 import (
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
+	"os"
 	"strings"
 	"testing"
 	//"reflect"
 )
 
 func TestEmphasis(t *testing.T) {
-	ee := Emphasis{Text{"Hello"}, true, false}
+	ee := Emphasis{Text{content: "Hello"}, true, false}
 	expected_txt := "_Hello_"
 	expected_html := "<em>Hello</em>"
 
@@ -20,7 +24,7 @@ func TestEmphasis(t *testing.T) {
 func TestHeaderStruct(t *testing.T) {
 	coll := Header{}
 	coll.Level = 3
-	coll.AddElement(&Text{"Hello World!"})
+	coll.AddElement(&Text{content: "Hello World!"})
 
 	expected_txt := "### Hello World! ###"
 	expected_html := "<h3>Hello World!</h3>"
@@ -44,16 +48,16 @@ func compareStrings(lhs, rhs []string) bool {
 
 func TestParagraphStruct(t *testing.T) {
 	para := Paragraph{}
-	para.AddElement(&Text{"This is a test paragraph"})
-	para.AddElement(&Emphasis{Text{"that contains bold"}, false, true})
-	para.AddElement(&Text{"text."})
+	para.AddElement(&Text{content: "This is a test paragraph"})
+	para.AddElement(&Emphasis{Text{content: "that contains bold"}, false, true})
+	para.AddElement(&Text{content: "text."})
 	para.AddElement(&LineBreak{})
-	para.AddElement(&Text{"And text after a line break."})
+	para.AddElement(&Text{content: "And text after a line break."})
 
 	expected_html := "<p>This is a test paragraph <strong>that contains bold</strong> text."
 	expected_html += "</br>\nAnd text after a line break.</p>"
 
-	expected_text := []string{"This is a test paragraph *that contains bold* text.",
+	expected_text := []string{"This is a test paragraph **that contains bold** text.  ",
 		"And text after a line break."}
 
 	if para.ToHtml() != expected_html || !compareStrings(expected_text, para.ToStrings()) {
@@ -65,25 +69,24 @@ func TestParagraphStruct(t *testing.T) {
 
 func TestFootnotes(t *testing.T) {
 	para := Paragraph{}
-	para.AddElement(&Text{"This is some"})
+	para.AddElement(&Text{content: "This is some"})
 	foot := &Footnote{}
 
-	foot.AddElement(&Text{"Only"})
-	foot.AddElement(&Emphasis{Text{"four"}, false, true})
-	foot.AddElement(&Text{"words."})
+	foot.AddElement(&Text{content: "Only"})
+	foot.AddElement(&Emphasis{Text{content: "four"}, false, true})
+	foot.AddElement(&Text{content: "words."})
 
 	para.AddElement(foot)
-	para.AddElement(&Text{"text."})
+	para.AddElement(&Text{content: "text."})
 
 	expected_html := "<p>This is some† "
 	expected_html += "<span class=\"footnote\">†Only <strong>four</strong> words.</span> text.</p>"
 
 	expected_text := []string{
-		"This is some†",
+		"This is some† text.",
                 "",
-		"†Only *four* words.",
+		"†Only **four** words.",
                 "",
-		"text.",
 	}
 
 	if para.ToHtml() != expected_html {
@@ -101,26 +104,22 @@ func TestFootnotes(t *testing.T) {
 
 func TestSideNotes(t *testing.T) {
 	para := Paragraph{}
-	para.AddElement(&Text{"This is a sentence with a"})
+	para.AddElement(&Text{content: "This is a sentence with a"})
 	left := &Leftnote{}
-	left.AddElement(&Text{"L"})
+	left.AddElement(&Text{content: "L"})
 	para.AddElement(left)
-	para.AddElement(&Text{"leftnote. And this is a rightnote"})
+	para.AddElement(&Text{content: "leftnote. And this is a rightnote"})
 	right := &Rightnote{}
-	right.AddElement(&Text{"Rightnote text"})
+	right.AddElement(&Text{content: "Rightnote text"})
 	para.AddElement(right)
-	para.AddElement(&Text{"sentence."})
+	para.AddElement(&Text{content: "sentence."})
 
 	expected_html := "<p>This is a sentence with a <span class=\"leftnote\">˙L</span> "
 	expected_html += "˙leftnote. And this is a rightnote˚ <span class=\"rightnote\">"
 	expected_html += "˚Rightnote text</span> sentence.</p>"
 
 	expected_text := []string{
-		"This is a sentence with a",
-		"˙L",
-		"˙leftnote. And this is a rightnote˚",
-		"˚Rightnote text",
-		"sentence.",
+		"˙L   This is a sentence with a ˙leftnote. And this is a rightnote˚ sentence.   ˚Rightnote text",
 	}
 
 	if para.ToHtml() != expected_html {
@@ -140,15 +139,15 @@ func TestBlockQuote(t *testing.T) {
 	quote := BlockQuote{}
 
 	para := Paragraph{}
-	para.AddElement(&Text{"This is a sentence with a"})
+	para.AddElement(&Text{content: "This is a sentence with a"})
 	left := &Leftnote{}
-	left.AddElement(&Text{"L"})
+	left.AddElement(&Text{content: "L"})
 	para.AddElement(left)
-	para.AddElement(&Text{"leftnote. And this is a rightnote"})
+	para.AddElement(&Text{content: "leftnote. And this is a rightnote"})
 	right := &Rightnote{}
-	right.AddElement(&Text{"Rightnote text"})
+	right.AddElement(&Text{content: "Rightnote text"})
 	para.AddElement(right)
-	para.AddElement(&Text{"sentence."})
+	para.AddElement(&Text{content: "sentence."})
 
 	quote.AddParagraph(para)
 	quote.AddParagraph(para)
@@ -167,18 +166,10 @@ func TestBlockQuote(t *testing.T) {
 	expected_html += "</blockquote>"
 
 	expected_text := []string{
-		"    This is a sentence with a",
-		"    ˙L",
-		"    ˙leftnote. And this is a rightnote˚",
-		"    ˚Rightnote text",
-		"    sentence.",
-		"    ",
-		"    This is a sentence with a",
-		"    ˙L",
-		"    ˙leftnote. And this is a rightnote˚",
-		"    ˚Rightnote text",
-		"    sentence.",
-		"    ",
+		"    ˙L   “This is a sentence with a ˙leftnote. And this is a rightnote˚ sentence.   ˚Rightnote text",
+		"",
+		"    ˙L   This is a sentence with a ˙leftnote. And this is a rightnote˚ sentence.”   ˚Rightnote text",
+		"",
 		"    Joel",
 	}
 
@@ -203,12 +194,12 @@ func TestBlockQuote(t *testing.T) {
 func TestInlineQuote(t *testing.T) {
 	para := Paragraph{}
 
-	para.AddElement(&Text{"This is a sentence with an"})
+	para.AddElement(&Text{content: "This is a sentence with an"})
 	quote := InlineQuote{}
-	quote.AddElement(&Text{"inline quote as part of the"})
+	quote.AddElement(&Text{content: "inline quote as part of the"})
 	quote.Citation = "Joel"
 	para.AddElement(&quote)
-	para.AddElement(&Text{"sentence."})
+	para.AddElement(&Text{content: "sentence."})
 
 	expected_html := "<p>This is a sentence with an <q cite=\"Joel\">"
 	expected_html += "inline quote as part of the</q> sentence.</p>"
@@ -254,7 +245,7 @@ func collectionHtml(coll []Collection) string {
 func TestImport(t *testing.T) {
 	document := "# Title #\n"
 	document += "\n"
-	document += "A short *paragraph* that doesn't say very\n"
+	document += "A short **paragraph** that doesn't say very\n"
 	document += "much and is wrapped by _hand_ to make sure\n"
 	document += "that we are smart enought to pick up the\n"
 	document += "entire paragraph.\n"
@@ -281,16 +272,16 @@ func TestImport(t *testing.T) {
 
 	expected := "# Title #\n"
 	expected += "\n"
-	expected += "A short *paragraph* that doesn't say very "
+	expected += "A short **paragraph** that doesn't say very "
 	expected += "much and is wrapped by _hand_ to make sure "
 	expected += "that we are smart enought to pick up the "
 	expected += "entire paragraph.\n"
 	expected += "\n"
 	expected += "## Header2 ##\n"
 	expected += "\n"
-	expected += "A short paragraph that doesn't say anything.\n"
-	expected += "But Roses are Red\n"
-	expected += "And Violets aren't\n"
+	expected += "A short paragraph that doesn't say anything.  \n"
+	expected += "But Roses are Red  \n"
+	expected += "And Violets aren't  \n"
 	expected += "Poetry is great! Isn't it?\n\n"
 
 	ss := collectionString(coll)
@@ -299,13 +290,13 @@ func TestImport(t *testing.T) {
 		t.Fail()
 	}
 
-	expected_html := "<h1>Title</h1>\n"
+	expected_html := "<h1 id=\"title\">Title</h1>\n"
 	expected_html += "<p>A short <strong>paragraph</strong> "
 	expected_html += "that doesn't say very much and is wrapped "
 	expected_html += "by <em>hand</em> to make sure that we are "
 	expected_html += "smart enought to pick up the entire "
 	expected_html += "paragraph.</p>\n"
-	expected_html += "<h2>Header2</h2>\n"
+	expected_html += "<h2 id=\"header2\">Header2</h2>\n"
 	expected_html += "<p>A short paragraph that doesn't say anything.</br>\n"
 	expected_html += "But Roses are Red</br>\n"
 	expected_html += "And Violets aren't</br>\n"
@@ -344,6 +335,82 @@ func TestUnicode(t *testing.T) {
 	}
 }
 
+func TestNormalize(t *testing.T) {
+	cases := map[string]string{
+		"\u1F71":                   "\u03AC", // alpha with oxia, tonos
+		"\u03B1\u0301":             "\u03AC", // alpha, acute
+		"\u03B1\u0313\u0301":       "\u1F04", // alpha, psili, acute
+		"\u03C9\u0345\u0314\u0342": "\u1FA7", // omega, ypogegrammeni, dasia, perispomeni
+		"\u1FFD":                   "\u00B4", // oxia
+		"μῆνιν ἄειδε θεὰ":           "μῆνιν ἄειδε θεὰ",
+	}
+	for input, expected := range cases {
+		if Normalize(input) != expected {
+			fmt.Printf("%+q -> %+q\n", input, Normalize(input))
+			t.Fail()
+		}
+	}
+}
+
+func TestImportNotNormalized(t *testing.T) {
+	document := "μῆνιν ἄειδε θεὰ\n"
+	document += "Πηληι\u0308άδεω Ἀχιλη\u0342ος\n"
+
+	_, err := Import(document)
+	errs, ok := err.(ErrorList)
+	if !ok || len(errs) != 2 {
+		fmt.Println(err)
+		t.FailNow()
+	}
+	if errs[0].Code != ErrNotNormalized || errs[0].Line != 2 || errs[0].Column != 5 ||
+		errs[1].Line != 2 || errs[1].Column != 16 {
+		fmt.Println(err)
+		t.Fail()
+	}
+
+	if _, err := Import(Normalize(document)); err != nil {
+		fmt.Println(err)
+		t.Fail()
+	}
+}
+
+func TestImportBadCharacters(t *testing.T) {
+	document := "# Title #\n"
+	document += "\n"
+	document += "Bad \xe1\xe9 bytes and a\ttab,\n"
+	document += "a bell\a and a † on its own.\n"
+	document += "A ‖ outside a quote.\n"
+
+	_, err := Import(document)
+	errs, ok := err.(ErrorList)
+	if !ok || len(errs) != 5 {
+		fmt.Println(err)
+		t.FailNow()
+	}
+
+	expected := []struct {
+		code   ErrorCode
+		line   int
+		column int
+	}{
+		{ErrInvalidEncoding, 3, 5},
+		{ErrTab, 3, 19},
+		{ErrControlCharacter, 4, 7},
+		{ErrMisplacedMarkup, 4, 15},
+		{ErrMisplacedMarkup, 5, 3},
+	}
+	for ii, ee := range expected {
+		if errs[ii].Code != ee.code || errs[ii].Line != ee.line || errs[ii].Column != ee.column {
+			fmt.Println(errs[ii])
+			t.Fail()
+		}
+	}
+	if errs[0].Snippet != "\"\\xe1\\xe9\"" {
+		fmt.Println(errs[0].Snippet)
+		t.Fail()
+	}
+}
+
 func printComparedStrings(ss1, ss2 string) {
         fmt.Printf("||%v||\n", ss1)
         fmt.Printf("||%v||\n", ss2)
@@ -384,7 +451,7 @@ func TestImportFootnotes(t *testing.T) {
         document += "\n"
 	document += "This is a test paragraph continued after the footnote.\n"
 
-        expected_html := "<h1>Title</h1>\n"
+        expected_html := "<h1 id=\"title\">Title</h1>\n"
         expected_html += "<p>This is a test paragraph line one. This is a test† "
         expected_html += "<span class=\"footnote\">†Hello world</span> paragraph line two "
         expected_html += "(with footnote after test). This is a test paragraph line three. "
@@ -392,14 +459,14 @@ func TestImportFootnotes(t *testing.T) {
 
         expected_text := "# Title #\n"
         expected_text += "\n"
-        expected_text += "This is a test paragraph line one. This is a test†\n"
-        expected_text += "\n"
-        expected_text += "†Hello world\n"
-        expected_text += "\n"
+        expected_text += "This is a test paragraph line one. This is a test† "
         expected_text += "paragraph line two (with footnote after test). "
         expected_text += "This is a test paragraph line three. This is a test "
         expected_text += "paragraph continued after the footnote.\n"
         expected_text += "\n"
+        expected_text += "†Hello world\n"
+        expected_text += "\n"
+        expected_text += "\n"
 
 	coll, err := Import(document)
 	if err != nil {
@@ -418,18 +485,69 @@ func TestImportFootnotes(t *testing.T) {
         }
 }
 
-/* func TestImportBadSidenotes(t *testing.T) {
+func TestImportBadSidenotes(t *testing.T) {
         document := "# Test document #\n"
         document += "This is a paragraph\n"
         document += "˙Bad Left sidenote\n"
         document += "This is a sentence\n"
 
         _, err := Import(document)
-        if err == nil || err.Error() != "Mismatched sidenotes" {
+        errs, ok := err.(ErrorList)
+        if !ok || len(errs) != 2 || errs[0].Message != "Mismatched sidenotes" ||
+                errs[0].Code != ErrMismatchedSidenotes || errs[0].Line != 3 ||
+                errs[1].Code != ErrMisplacedMarkup {
                 fmt.Println(err)
                 t.Fail()
         }
-} */
+}
+
+func TestImportErrors(t *testing.T) {
+	document := "## Bad header #\n"
+	document += "\n"
+	document += "A paragraph with a *quote “across* emphasis”.\n"
+	document += "\n"
+	document += "Another paragraph˚\n"
+
+	coll, err := Import(document)
+	errs, ok := err.(ErrorList)
+	if !ok || len(errs) != 4 {
+		fmt.Println(err)
+		t.FailNow()
+	}
+
+	expected := []ParseError{
+		{Position{1, 1, 0}, ErrHeaderLevels, "Header levels not matched", "## Bad header #"},
+		{Position{3, 27, 43}, ErrEmphasisInQuote, "Emphasis crosses quotation", "“"},
+		{Position{5, 1, 68}, ErrMismatchedSidenotes, "Mismatched sidenotes", "Another paragraph˚"},
+		{Position{5, 18, 85}, ErrMisplacedMarkup, "Misplaced ˚", "˚"},
+	}
+	for ii, ee := range expected {
+		if *errs[ii] != ee {
+			fmt.Printf("%#v\n", *errs[ii])
+			t.Fail()
+		}
+	}
+
+	if len(coll) != 3 {
+		fmt.Println(len(coll))
+		t.Fail()
+	}
+}
+
+func TestLinearizeNodes(t *testing.T) {
+	para := &Paragraph{Block{Span: Span{Position{Offset: 12}, Position{Offset: 20}}}}
+	for _, linearize := range []func(*([]intermediates)) ([]intermediates, error){
+		linearizeLeftnotes, linearizeRightnotes,
+	} {
+		inters := append(sourceLines("First line\n"), para)
+		_, err := linearize(&inters)
+		pe, ok := err.(*ParseError)
+		if !ok || pe.Code != ErrUnexpectedType || pe.Offset != 12 {
+			fmt.Println(err)
+			t.Fail()
+		}
+	}
+}
 
 func TestLeftLinearize(t *testing.T) {
         inters := []intermediates{}
@@ -471,3 +589,1562 @@ func TestLeftLinearize(t *testing.T) {
 
 
 
+func TestImportSidenotes(t *testing.T) {
+	document := "# Title #\n"
+	document += "\n"
+	document += "           This is a sentence\n"
+	document += "˙Left      with a ˙leftnote.\n"
+	document += "sidenote   And this is a\n"
+	document += "text       rightnote˚ sentence    ˚Rightnote\n"
+	document += "           with a footnote†       text\n"
+	document += "           after.                 that is\n"
+	document += "                                  long\n"
+	document += "\n"
+	document += "†Footnote\n"
+	document += "\n"
+	document += "           The paragraph goes on.\n"
+
+	expected_html := "<h1 id=\"title\">Title</h1>\n"
+	expected_html += "<p>This is a sentence with a <span class=\"leftnote\">˙Left sidenote text</span> "
+	expected_html += "˙leftnote. And this is a rightnote˚ <span class=\"rightnote\">"
+	expected_html += "˚Rightnote text that is long</span> sentence with a footnote† "
+	expected_html += "<span class=\"footnote\">†Footnote</span> after. The paragraph goes on.</p>\n"
+
+	coll, err := Import(document)
+	if err != nil {
+		fmt.Println(err)
+		t.Fail()
+	}
+
+	if collectionHtml(coll) != expected_html {
+		printComparedStrings(collectionHtml(coll), expected_html)
+		t.Fail()
+	}
+
+	// A quotation after a footnote ends the paragraph
+	document = "           He said sing† the\n"
+	document += "˙Achilles  ˙wrath.\n"
+	document += "\n"
+	document += "†The verb.\n"
+	document += "\n"
+	document += "    A quoted† line.\n"
+	document += "\n"
+	document += "    †Quote note\n"
+	document += "\n"
+	document += "\n"
+	document += "    Another.\n"
+
+	expected_html = "<p>He said sing† <span class=\"footnote\">†The verb.</span> the "
+	expected_html += "<span class=\"leftnote\">˙Achilles</span> ˙wrath.</p>\n"
+	expected_html += "<blockquote>\n"
+	expected_html += "<p>A quoted† <span class=\"footnote\">†Quote note</span> line.</p>\n"
+	expected_html += "<p>Another.</p>\n"
+	expected_html += "</blockquote>\n"
+
+	coll, err = Import(document)
+	if err != nil {
+		fmt.Println(err)
+		t.Fail()
+	}
+	if collectionHtml(coll) != expected_html {
+		printComparedStrings(collectionHtml(coll), expected_html)
+		t.Fail()
+	}
+}
+
+func TestJustifySidenotes(t *testing.T) {
+	para := Paragraph{}
+	para.AddElement(&Text{content: "This is a sentence with a"})
+	left := &Leftnote{}
+	left.AddElement(&Text{content: "Left sidenote text"})
+	para.AddElement(left)
+	para.AddElement(&Text{content: "leftnote. And this is a rightnote"})
+	right := &Rightnote{}
+	right.AddElement(&Text{content: "Rightnote text that is long"})
+	para.AddElement(right)
+	para.AddElement(&Text{content: "sentence with a footnote"})
+	foot := &Footnote{}
+	foot.AddElement(&Text{content: "Footnote"})
+	para.AddElement(foot)
+	para.AddElement(&Text{content: "after."})
+
+	expected := []string{
+		"           This is a sentence",
+		"˙Left      with a ˙leftnote.",
+		"sidenote   And this is a",
+		"text       rightnote˚ sentence    ˚Rightnote",
+		"           with a footnote†       text",
+		"           after.                 that is",
+		"                                  long",
+		"",
+		"†Footnote",
+		"",
+	}
+
+	lines, err := Justification{Width: 20, NoteWidth: 8}.Lines([]Collection{&para})
+	if err != nil || !compareStrings(expected, lines) {
+		fmt.Println(err)
+		for _, ll := range lines {
+			fmt.Printf("||%v||\n", ll)
+		}
+		t.Fail()
+	}
+}
+
+func TestReformat(t *testing.T) {
+	document := "# Title #\n"
+	document += "\n"
+	document += "A short paragraph with a† dagger and\n"
+	document += "another† one in it, wrapped by hand.\n"
+	document += "\n"
+	document += "†First footnote\n"
+	document += "\n"
+	document += "†Second footnote\n"
+	document += "\n"
+	document += "Roses are red  \n"
+	document += "Violets are blue\n"
+
+	expected := "# Title #\n"
+	expected += "\n"
+	expected += "A short paragraph with a†\n"
+	expected += "\n"
+	expected += "†First footnote\n"
+	expected += "\n"
+	expected += "dagger and another† one in it,\n"
+	expected += "\n"
+	expected += "†Second footnote\n"
+	expected += "\n"
+	expected += "wrapped by hand. Roses are red  \n"
+	expected += "Violets are blue"
+
+	output, err := Reformat(document, Justification{Width: 30, NoteWidth: 10})
+	if err != nil || output != expected {
+		fmt.Println(err)
+		printComparedStrings(output, expected)
+		t.Fail()
+	}
+
+	again, err := Reformat(output, Justification{Width: 30, NoteWidth: 10})
+	if err != nil || again != output {
+		fmt.Println(err)
+		printComparedStrings(again, output)
+		t.Fail()
+	}
+}
+
+func TestConvert(t *testing.T) {
+	document := "# The Iliad & Odyssey #\n"
+	document += "\n"
+	document += "Sing, goddess, the wrath.\n"
+
+	expected := "<!DOCTYPE html>\n"
+	expected += "<html>\n"
+	expected += "<head>\n"
+	expected += "<meta charset=\"utf-8\">\n"
+	expected += "<title>The Iliad &amp; Odyssey</title>\n"
+	expected += "<link rel=\"stylesheet\" href=\"homer.css\">\n"
+	expected += "</head>\n"
+	expected += "<body>\n"
+	expected += "<h1 id=\"the-iliad-odyssey\">The Iliad &amp; Odyssey</h1>\n"
+	expected += "<p>Sing, goddess, the wrath.</p>\n"
+	expected += "</body>\n"
+	expected += "</html>"
+
+	output, err := ConvertHtml(document, HtmlOptions{Stylesheet: "homer.css"})
+	if err != nil || output != expected {
+		fmt.Println(err)
+		printComparedStrings(output, expected)
+		t.Fail()
+	}
+}
+
+func TestImportQuote(t *testing.T) {
+	document := "Lincoln said:\n"
+	document += "\n"
+	document += "    “Four score and **seven** years ago our†\n"
+	document += "    fathers brought forth on this continent\n"
+	document += "\n"
+	document += "    †Lincoln counts in scores\n"
+	document += "\n"
+	document += "    a new nation.\n"
+	document += "\n"
+	document += "    Now we are engaged in a great civil\n"
+	document += "    war.”\n"
+	document += "\n"
+	document += "    Abraham Lincoln, G. A.\n"
+	document += "\n"
+	document += "And so on.\n"
+
+	expected_html := "<p>Lincoln said:</p>\n"
+	expected_html += "<blockquote cite=\"Abraham Lincoln, G. A.\">\n"
+	expected_html += "<p>Four score and <strong>seven</strong> years ago our† "
+	expected_html += "<span class=\"footnote\">†Lincoln counts in scores</span> "
+	expected_html += "fathers brought forth on this continent a new nation.</p>\n"
+	expected_html += "<p>Now we are engaged in a great civil war.</p>\n"
+	expected_html += "</blockquote>\n"
+	expected_html += "<p>And so on.</p>\n"
+
+	coll, err := Import(document)
+	if err != nil {
+		fmt.Println(err)
+		t.Fail()
+	}
+
+	if len(coll) != 3 {
+		fmt.Printf("Collection size: %d\n", len(coll))
+		t.FailNow()
+	}
+
+	quote, ok := coll[1].(*BlockQuote)
+	if !ok || len(quote.Paragraphs) != 2 || quote.Citation != "Abraham Lincoln, G. A." {
+		fmt.Println(coll[1])
+		t.Fail()
+	}
+
+	if collectionHtml(coll) != expected_html {
+		printComparedStrings(collectionHtml(coll), expected_html)
+		t.Fail()
+	}
+}
+
+func TestImportInlineQuote(t *testing.T) {
+	document := "Inline quotes use the same technique. “Curly quotes\n"
+	document += "begin and end the _quote_† ‖ Myself” and a\n"
+	document += "double bar cites.\n"
+	document += "\n"
+	document += "†A note in the quote\n"
+	document += "\n"
+	document += "It goes on “across a break  \n"
+	document += "and a right˚ note” here.       ˚Right\n"
+	document += "\n"
+	document += "An “unclosed quote stays text.\n"
+
+	expected_html := "<p>Inline quotes use the same technique. <q cite=\"Myself\">Curly quotes "
+	expected_html += "begin and end the <em>quote</em>† <span class=\"footnote\">†A note in the quote</span>"
+	expected_html += "</q> and a double bar cites. It goes on <q>across a break</br>\n"
+	expected_html += "and a right˚ <span class=\"rightnote\">˚Right</span> note</q> here.</p>\n"
+	expected_html += "<p>An “unclosed quote stays text.</p>\n"
+
+	coll, err := Import(document)
+	if err != nil {
+		fmt.Println(err)
+		t.Fail()
+	}
+
+	if collectionHtml(coll) != expected_html {
+		printComparedStrings(collectionHtml(coll), expected_html)
+		t.Fail()
+	}
+
+	para, ok := coll[0].(*Paragraph)
+	if !ok {
+		t.FailNow()
+	}
+	quote, ok := para.Elements[1].(*InlineQuote)
+	if !ok || quote.Citation != "Myself" || len(quote.Elements) != 3 {
+		fmt.Println(para.Elements)
+		t.Fail()
+	}
+}
+
+func TestImportEmphasis(t *testing.T) {
+	document := "Some ***bold italic*** and __bold *nested* bold__ text.\n"
+	document += "\n"
+	document += "A critical sign * stays, \\*escaped\\* too, and snake_case.\n"
+	document += "\n"
+	document += "An *unclosed emphasis.\n"
+
+	expected_html := "<p>Some <strong><em>bold italic</em></strong> and <strong>bold</strong> "
+	expected_html += "<strong><em>nested</em></strong> <strong>bold</strong> text.</p>\n"
+	expected_html += "<p>A critical sign * stays, *escaped* too, and snake_case.</p>\n"
+	expected_html += "<p>An *unclosed emphasis.</p>\n"
+
+	coll, err := Import(document)
+	errs, ok := err.(ErrorList)
+	if !ok || len(errs) != 1 || errs[0].Code != ErrUnclosedEmphasis ||
+		errs[0].Line != 5 || errs[0].Column != 4 {
+		fmt.Println(err)
+		t.Fail()
+	}
+
+	if collectionHtml(coll) != expected_html {
+		printComparedStrings(collectionHtml(coll), expected_html)
+		t.Fail()
+	}
+
+	expected_text := "Some **_bold italic_** and **bold** **_nested_** **bold** text.\n\n"
+	expected_text += "A critical sign * stays, \\*escaped\\* too, and snake_case.\n\n"
+	if collectionString(coll[:2]) != expected_text {
+		printComparedStrings(collectionString(coll[:2]), expected_text)
+		t.Fail()
+	}
+
+	again, err := Import(collectionString(coll[:2]))
+	if err != nil || collectionHtml(again) != collectionHtml(coll[:2]) {
+		fmt.Println(err)
+		t.Fail()
+	}
+}
+
+func TestImportHeader(t *testing.T) {
+	document := "# Book *Α*: The “Wrath”† #\n"
+	document += "\n"
+	document += "†Homer, *Iliad*\n"
+	document += "\n"
+	document += "## Catalogue˚ ##      ˚Book 2\n"
+
+	expected_html := "<h1 id=\"book-a-the-wrath\">Book <em>Α</em>: The <q>Wrath</q>† "
+	expected_html += "<span class=\"footnote\">†Homer, <em>Iliad</em></span></h1>\n"
+	expected_html += "<h2 id=\"catalogue\">Catalogue˚ <span class=\"rightnote\">˚Book 2</span></h2>\n"
+
+	coll, err := Import(document)
+	if err != nil || collectionHtml(coll) != expected_html {
+		fmt.Println(err)
+		printComparedStrings(collectionHtml(coll), expected_html)
+		t.FailNow()
+	}
+
+	head := coll[0].(*Header)
+	if head.Level != 1 || len(head.Elements) != 5 {
+		fmt.Println(head.Elements)
+		t.Fail()
+	}
+
+	expected_text := []string{
+		"# Book _Α_: The “Wrath”† #",
+		"",
+		"†Homer, _Iliad_",
+		"",
+	}
+	if !compareStrings(head.ToStrings(), expected_text) {
+		fmt.Println(head.ToStrings())
+		t.Fail()
+	}
+}
+
+func TestSlug(t *testing.T) {
+	cases := map[string]string{
+		"Book 2, Catalogue of Ships": "book-2-catalogue-of-ships",
+		"Ὅμηρος":                     "homeros",
+		"Οἱ ἄγγελοι":                 "hoi-angeloi",
+		"Εὐρώπη καὶ ῥήτωρ":           "europe-kai-rhetor",
+		"Βιβλίον Β: Νεῶν κατάλογος":  "biblion-b-neon-katalogos",
+		"Ψυχή & Θάνατος":             "psyche-thanatos",
+		"Café":                       "cafe",
+		"…":                          "section",
+	}
+	for input, expected := range cases {
+		if slug(input) != expected {
+			fmt.Printf("%v -> %v\n", input, slug(input))
+			t.Fail()
+		}
+	}
+}
+
+func TestImportHeaderAnchors(t *testing.T) {
+	document := "# Ἰλιάς\n"
+	document += "\n"
+	document += "## Book 2, Catalogue of Ships ##\n"
+	document += "\n"
+	document += "#hashtag and C# stay text\n"
+	document += "\n"
+	document += "## Book 2, *Catalogue of Ships*\n"
+
+	expected_html := "<h1 id=\"ilias\">Ἰλιάς</h1>\n"
+	expected_html += "<h2 id=\"book-2-catalogue-of-ships\">Book 2, Catalogue of Ships</h2>\n"
+	expected_html += "<p>#hashtag and C# stay text</p>\n"
+	expected_html += "<h2 id=\"book-2-catalogue-of-ships-2\">Book 2, <em>Catalogue of Ships</em></h2>\n"
+
+	coll, err := Import(document)
+	if err != nil {
+		fmt.Println(err)
+		t.FailNow()
+	}
+	toc := TableOfContents(coll)
+	if len(toc.Warnings) != 1 || toc.Warnings[0] != "Duplicate anchor book-2-catalogue-of-ships: \"Book 2, Catalogue of Ships\" is book-2-catalogue-of-ships-2" {
+		fmt.Println(toc.Warnings)
+		t.Fail()
+	}
+
+	if collectionHtml(coll) != expected_html {
+		printComparedStrings(collectionHtml(coll), expected_html)
+		t.Fail()
+	}
+}
+
+func TestTableOfContents(t *testing.T) {
+	document := "# Ἰλιάς #\n"
+	document += "\n"
+	document += "## Book 1, *The Wrath*† ##\n"
+	document += "\n"
+	document += "†Of Achilles\n"
+	document += "\n"
+	document += "## Book 2 ##\n"
+	document += "\n"
+	document += "#### Catalogue of Ships ####\n"
+	document += "\n"
+	document += "Text.\n"
+
+	coll, err := Import(document)
+	if err != nil {
+		fmt.Println(err)
+		t.FailNow()
+	}
+	toc := TableOfContents(coll)
+
+	expected_html := "<nav class=\"contents\">\n<ul>\n"
+	expected_html += "<li><a href=\"#ilias\">Ἰλιάς</a>\n<ul>\n"
+	expected_html += "<li><a href=\"#book-1-the-wrath\">Book 1, <em>The Wrath</em></a></li>\n"
+	expected_html += "<li><a href=\"#book-2\">Book 2</a>\n<ul>\n"
+	expected_html += "<li><a href=\"#catalogue-of-ships\">Catalogue of Ships</a></li>\n"
+	expected_html += "</ul></li>\n</ul></li>\n</ul>\n</nav>"
+
+	if toc.ToHtml() != expected_html {
+		printComparedStrings(toc.ToHtml(), expected_html)
+		t.Fail()
+	}
+
+	expected_text := []string{
+		"1. Ἰλιάς  ",
+		"1.1. Book 1, _The Wrath_  ",
+		"1.2. Book 2  ",
+		"1.2.1. Catalogue of Ships",
+	}
+	if !compareStrings(toc.ToStrings(), expected_text) {
+		fmt.Println(toc.ToStrings())
+		t.Fail()
+	}
+
+	if len(toc.Warnings) != 1 || toc.Warnings[0] != "Header level skipped: h2 -> h4 at \"Catalogue of Ships\"" {
+		fmt.Println(toc.Warnings)
+		t.Fail()
+	}
+
+	coll, err = Import("### Catalogue of Ships ###\n\n## Book 3 ##\n")
+	if err != nil {
+		fmt.Println(err)
+		t.FailNow()
+	}
+	toc = TableOfContents(coll)
+	if len(toc.Warnings) != 1 || toc.Warnings[0] != "Header level skipped: first header is h3 at \"Catalogue of Ships\"" {
+		fmt.Println(toc.Warnings)
+		t.Fail()
+	}
+}
+
+func TestEndnotes(t *testing.T) {
+	document := "# Book 1 #\n"
+	document += "\n"
+	document += "Sing† the wrath† of Achilles.\n"
+	document += "\n"
+	document += "†Or tell\n"
+	document += "\n"
+	document += "†Anger\n"
+	document += "\n"
+	document += "# Book 2 #\n"
+	document += "\n"
+	document += "The ships†.\n"
+	document += "\n"
+	document += "†A *catalogue*\n"
+
+	coll, err := Import(document)
+	if err != nil {
+		fmt.Println(err)
+		t.FailNow()
+	}
+
+	ref := func(id, mark string) string {
+		return "<sup class=\"footnote-ref\" id=\"fnref-" + id + "\"><a href=\"#fn-" + id + "\">" + mark + "</a></sup>"
+	}
+	note := func(id, mark, body string) string {
+		return "<p id=\"fn-" + id + "\"><a class=\"footnote-back\" href=\"#fnref-" + id + "\">" + mark + "</a> " + body + "</p>\n"
+	}
+
+	expected := "<h1 id=\"book-1\">Book 1</h1>\n"
+	expected += "<p>Sing" + ref("1", "†") + " the wrath" + ref("2", "‡") + " of Achilles.</p>\n"
+	expected += "<section class=\"footnotes\">\n" + note("1", "†", "Or tell") + note("2", "‡", "Anger") + "</section>\n"
+	expected += "<h1 id=\"book-2\">Book 2</h1>\n"
+	expected += "<p>The ships" + ref("3", "†") + ".</p>\n"
+	expected += "<section class=\"footnotes\">\n" + note("3", "†", "A <em>catalogue</em>") + "</section>\n"
+	expected += "</body>\n</html>"
+
+	output, err := HtmlDocument(coll, HtmlOptions{Footnotes: SymbolFootnotes, Endnotes: ChapterEndnotes})
+	if err != nil || !strings.HasSuffix(output, expected) {
+		printComparedStrings(output[strings.Index(output, "<h1"):], expected)
+		t.Fail()
+	}
+
+	output, err = HtmlDocument(coll, HtmlOptions{Footnotes: NumberedFootnotes})
+	expected = "<p>The ships" + ref("3", "3") + ".</p>\n"
+	expected += "<section class=\"footnotes\">\n" + note("1", "1", "Or tell") + note("2", "2", "Anger")
+	expected += note("3", "3", "A <em>catalogue</em>") + "</section>\n"
+	if err != nil || !strings.Contains(output, expected) {
+		fmt.Println(output)
+		t.Fail()
+	}
+
+	if _, ok := coll[1].(*Paragraph).Elements[1].(*Footnote); !ok {
+		t.Fail()
+	}
+}
+
+func TestRenderBadTree(t *testing.T) {
+	foot := &Footnote{}
+	foot.Elements = append(foot.Elements, &LineBreak{})
+	para := &Paragraph{}
+	para.AddElement(&Text{content: "A paragraph"})
+	para.AddElement(foot)
+
+	if para.ToHtml() == "" || len(para.ToStrings()) == 0 {
+		t.Fail()
+	}
+
+	if _, err := CheckedHtml(para); err == nil {
+		t.Fail()
+	}
+	if _, err := CheckedStrings(para); err == nil {
+		t.Fail()
+	}
+	if _, err := HtmlDocument([]Collection{para}, HtmlOptions{}); err == nil {
+		t.Fail()
+	}
+	if _, err := (Justification{60, 16}).Lines([]Collection{para}); err == nil {
+		t.Fail()
+	}
+
+	good := &Paragraph{}
+	good.AddElement(&Text{content: "A paragraph"})
+	if _, err := CheckedHtml(good); err != nil {
+		fmt.Println(err)
+		t.Fail()
+	}
+}
+
+func TestEscapeHtml(t *testing.T) {
+	para := Paragraph{}
+	para.AddElement(&Text{content: "Commentary on <b> & 1 &#8212; 2 &#x2014; 3 &#0; &amp;"})
+	quote := InlineQuote{}
+	quote.AddElement(&Emphasis{Text{content: "a < b"}, true, false})
+	quote.Citation = "Smith, \"On Signs\" & 'Others'"
+	para.AddElement(&quote)
+
+	expected_html := "<p>Commentary on &lt;b&gt; &amp; 1 &#8212; 2 &#x2014; 3 &amp;#0; &amp;amp; "
+	expected_html += "<q cite=\"Smith, &quot;On Signs&quot; &amp; &#39;Others&#39;\">"
+	expected_html += "<em>a &lt; b</em></q></p>"
+
+	if para.ToHtml() != expected_html {
+		printComparedStrings(para.ToHtml(), expected_html)
+		t.Fail()
+	}
+
+	if quote.ToText() != "_a < b_ ‖ Smith, \"On Signs\" & 'Others'" {
+		fmt.Println(quote.ToText())
+		t.Fail()
+	}
+}
+
+func TestMarginProfile(t *testing.T) {
+	para := &Paragraph{}
+	para.AddElement(&Text{content: "This is a sentence with a"})
+	left := &Leftnote{}
+	left.AddElement(&Text{content: "L"})
+	para.AddElement(left)
+	para.AddElement(&Text{content: "leftnote and a rightnote"})
+	right := &Rightnote{}
+	right.AddElement(&Text{content: "Rightnote text"})
+	para.AddElement(right)
+	para.AddElement(&Text{content: "and a footnote"})
+	foot := &Footnote{}
+	foot.AddElement(&Text{content: "Footnote text"})
+	para.AddElement(foot)
+	coll := []Collection{para}
+
+	toggle := func(id, mark, class, body string) string {
+		output := "<label for=\"note-" + id + "\" class=\"margin-toggle\">" + mark + "</label>"
+		output += "<input type=\"checkbox\" id=\"note-" + id + "\" class=\"margin-toggle\"/>"
+		return output + "<span class=\"" + class + "\">" + body + "</span>"
+	}
+
+	expected := "<p>This is a sentence with a " + toggle("1", "˙", "leftnote", "L")
+	expected += " leftnote and a rightnote" + toggle("2", "˚", "rightnote", "Rightnote text")
+	expected += " and a footnote" + toggle("3", "†", "footnote", "Footnote text") + "</p>\n"
+
+	output, err := HtmlDocument(coll, HtmlOptions{Profile: MarginProfile, Stylesheet: "mine.css"})
+	if err != nil || !strings.Contains(output, expected) {
+		printComparedStrings(output, expected)
+		t.Fail()
+	}
+	style := strings.Index(output, "<style>\n"+MarginStylesheet+"</style>")
+	link := strings.Index(output, "<link rel=\"stylesheet\" href=\"mine.css\">")
+	if style == -1 || link < style {
+		fmt.Println(output)
+		t.Fail()
+	}
+
+	if _, ok := para.Elements[1].(*Leftnote); !ok {
+		t.Fail()
+	}
+
+	output, err = HtmlDocument(coll, HtmlOptions{})
+	if err != nil || strings.Contains(output, "<style>") || strings.Contains(output, "margin-toggle") {
+		fmt.Println(output)
+		t.Fail()
+	}
+}
+
+func TestTheme(t *testing.T) {
+	for _, selector := range []string{".leftnote", ".rightnote", ".footnote", "blockquote[cite]", "@media print"} {
+		if !strings.Contains(ThemeStylesheet, selector) {
+			fmt.Println("Theme has no " + selector)
+			t.Fail()
+		}
+	}
+
+	coll := []Collection{&Paragraph{Block{Elements: []Element{&Text{content: "Text"}}}}}
+	output, err := HtmlDocument(coll, HtmlOptions{Theme: "marginalia.css", Stylesheet: "mine.css", Profile: MarginProfile})
+	theme := strings.Index(output, "<link rel=\"stylesheet\" href=\"marginalia.css\">")
+	style := strings.Index(output, "<style>")
+	link := strings.Index(output, "<link rel=\"stylesheet\" href=\"mine.css\">")
+	if err != nil || theme == -1 || style < theme || link < style {
+		fmt.Println(output)
+		t.Fail()
+	}
+
+	// The theme lays out only documents without the margin profile's
+	// own layout
+	if !strings.Contains(output, "<body class=\"margins\">") ||
+		!strings.Contains(ThemeStylesheet, "body:not(.margins) .leftnote {") {
+		fmt.Println(output)
+		t.Fail()
+	}
+}
+
+func TestFlowText(t *testing.T) {
+	document := "# The *Iliad* #\n"
+	document += "\n"
+	document += "Sing† the wrath of Achilles˚       ˚Peleus' son\n"
+	document += "that brought \\*countless\\* ills.\n"
+	document += "\n"
+	document += "†Or tell\n"
+	document += "\n\n"
+	document += "    “Rage, goddess”\n"
+	document += "\n"
+	document += "    Hom. Il. 1.1\n"
+
+	coll, err := Import(document)
+	if err != nil {
+		fmt.Println(err)
+		t.FailNow()
+	}
+
+	expected := "The Iliad\n"
+	expected += "\n"
+	expected += "Sing the wrath of Achilles that brought *countless* ills.\n"
+	expected += "\n"
+	expected += "    Rage, goddess\n"
+	expected += "\n"
+	expected += "    Hom. Il. 1.1"
+	output := FlowText(coll, FlowOptions{})
+	if output != expected {
+		printComparedStrings(output, expected)
+		t.Fail()
+	}
+	if coll[1].ToFlowText() != "Sing the wrath of Achilles that brought *countless* ills." {
+		fmt.Println(coll[1].ToFlowText())
+		t.Fail()
+	}
+
+	expected = "The Iliad\n"
+	expected += "\n"
+	expected += "Sing[1] the wrath of Achilles[2] that brought *countless* ills.\n"
+	expected += "\n"
+	expected += "    Rage, goddess\n"
+	expected += "\n"
+	expected += "    Hom. Il. 1.1\n"
+	expected += "\n"
+	expected += "[1] Or tell\n"
+	expected += "[2] Peleus' son"
+	output = FlowText(coll, FlowOptions{NoteNumbers: true})
+	if output != expected {
+		printComparedStrings(output, expected)
+		t.Fail()
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	documents := []string{
+		"# The *Iliad*† #\n\n†Homer\n\nSing, goddess, the **wrath**.\n",
+		"Word _em_. And **strong**, and **_both_**; done.\n",
+		"Escapes \\*not em\\* and \\\\ and snake_case_word.\n",
+		"Sing† the wrath.\n\n†Or tell\n\n\nNext paragraph.\n",
+		"Sing the wrath˚       ˚Peleus' son\nthat brought ills.\n",
+		"˙Left   Sing the ˙wrath\n       that brought ills.\n",
+		"He said “come here ‖ Il. 1” and left.\n",
+		"He said “come˚ here” and left.   ˚A note\n",
+		"Quote: “unclosed and more.\n",
+		"    “Rage, goddess,\n    sing.\n\n    Second paragraph†.”\n\n    †A note\n\n\n    Hom. Il. 1.1\n\nAfter.\n",
+		"Verse one  \nverse two  \nverse three.\n",
+		"Μῆνιν ἄειδε θεὰ Πηληϊάδεω Ἀχιλῆος† οὐλομένην.\n\n†Wrath\n",
+		"# Header with note˚ #   ˚Side\n\nText.\n",
+		"Last† one†.\n\n†First\n\n†Second\n",
+		"A (parenthesis)† and “quote”.\n\n†Note\n",
+	}
+
+	for _, jj := range []Justification{{}, {30, 10}} {
+		for _, document := range documents {
+			coll, err := Import(document)
+			if err != nil {
+				fmt.Printf("%q: %v\n", document, err)
+				t.Fail()
+				continue
+			}
+			once, err := Reformat(document, jj)
+			if err != nil {
+				fmt.Printf("%q: %v\n", document, err)
+				t.Fail()
+				continue
+			}
+			twice, err := Reformat(once, jj)
+			reimported, err2 := Import(once)
+			if err != nil || err2 != nil || once != twice || collectionHtml(coll) != collectionHtml(reimported) {
+				printComparedStrings(twice, once)
+				printComparedStrings(collectionHtml(reimported), collectionHtml(coll))
+				t.Fail()
+			}
+			if err := CheckCanonical(once+"\n", jj); err != nil {
+				fmt.Println(err)
+				t.Fail()
+			}
+		}
+	}
+
+	coll, _ := Import(documents[1])
+	if coll[0].ToStrings()[0] != "Word _em_. And **strong**, and **_both_**; done." {
+		fmt.Println(coll[0].ToStrings())
+		t.Fail()
+	}
+}
+
+func TestCheckCanonical(t *testing.T) {
+	document := "# Title #\n"
+	document += "\n"
+	document += "Sing *the* wrath\n"
+	document += "of Achilles.\n"
+
+	err := CheckCanonical(document, Justification{})
+	errs, ok := err.(ErrorList)
+	if !ok || len(errs) != 1 || errs[0].Code != ErrNotCanonical || errs[0].Line != 3 ||
+		errs[0].Message != "Not in canonical form, expected \"Sing _the_ wrath of Achilles.\"" {
+		fmt.Println(err)
+		t.Fail()
+	}
+
+	err = CheckCanonical(document+"\n", Justification{Width: 20})
+	errs, ok = err.(ErrorList)
+	if !ok || len(errs) != 1 || errs[0].Line != 3 || errs[0].Column != 1 {
+		fmt.Println(err)
+		t.Fail()
+	}
+
+	if err := CheckCanonical("# Title #\n\nSing _the_ wrath of Achilles.\n", Justification{}); err != nil {
+		fmt.Println(err)
+		t.Fail()
+	}
+}
+
+func TestCheckReader(t *testing.T) {
+	jj := Justification{Width: 20}
+	canonical := "# Title #\n\nSing _the_ wrath of\nAchilles.\n\n    “A quoted line.”\n\nThe end.\n"
+	if err := CheckReader(strings.NewReader(canonical), jj); err != nil {
+		fmt.Println(err)
+		t.Fail()
+	}
+
+	documents := []string{
+		"",
+		canonical + "\n",
+		strings.Replace(canonical, "The end.", "The  end.", 1),
+		strings.Replace(canonical, "    “A quoted", "\n    “A quoted", 1),
+		strings.TrimSuffix(canonical, "\n"),
+	}
+	for _, document := range documents {
+		expected := CheckCanonical(document, jj).(ErrorList)
+		errs, ok := CheckReader(strings.NewReader(document), jj).(ErrorList)
+		if !ok || len(errs) != 1 || *errs[0] != *expected[0] {
+			fmt.Println(errs, expected)
+			t.Fail()
+		}
+	}
+}
+
+func TestImportReader(t *testing.T) {
+	document := "# Book #\n"
+	document += "\n"
+	document += "Sing† the wrath\n"
+	document += "\n"
+	document += "†Or tell\n"
+	document += "\n"
+	document += "of Achilles˚       ˚Peleus' son\n"
+	document += "that brought ills.\n"
+	document += "\n"
+	document += "    “Rage, goddess,\n"
+	document += "\n"
+	document += "    sing.”\n"
+	document += "\n"
+	document += "    Hom. Il. 1.1\n"
+	document += "\n"
+	document += "Dagger† first,\n"
+	document += "\n"
+	document += "and more before the note.\n"
+	document += "\n"
+	document += "†Late\n"
+	document += "\n"
+	document += "\n"
+	document += "# Book #\n"
+	document += "\n"
+	document += "A *bad\n"
+	document += "emphasis.\n"
+
+	expected, expectedErr := Import(document)
+	if expectedErr == nil || len(expected) != 7 {
+		fmt.Println(len(expected), expectedErr)
+		t.FailNow()
+	}
+
+	importer := ImportReader(strings.NewReader(document))
+	coll := []Collection{}
+	errs := ErrorList{}
+	for {
+		cc, err := importer.Next()
+		if err == io.EOF {
+			break
+		}
+		if el, ok := err.(ErrorList); ok {
+			errs = append(errs, el...)
+		} else if err != nil {
+			fmt.Println(err)
+			t.FailNow()
+		}
+		if cc != nil {
+			coll = append(coll, cc)
+		}
+	}
+
+	if collectionHtml(coll) != collectionHtml(expected) {
+		printComparedStrings(collectionHtml(coll), collectionHtml(expected))
+		t.Fail()
+	}
+	if errs.Error() != expectedErr.Error() {
+		printComparedStrings(errs.Error(), expectedErr.Error())
+		t.Fail()
+	}
+	if len(errs) == 0 || errs[len(errs)-1].Offset != strings.Index(document, "*bad") {
+		fmt.Println(errs)
+		t.Fail()
+	}
+	spans, expectedSpans := documentSpans(coll), documentSpans(expected)
+	for ii := range expectedSpans {
+		if ii >= len(spans) || *spans[ii] != *expectedSpans[ii] {
+			fmt.Println(ii, expectedSpans[ii])
+			t.Fail()
+		}
+	}
+}
+
+func TestSourcePositions(t *testing.T) {
+	document := "# Book _Α_† #\n"
+	document += "\n"
+	document += "†Head note.\n"
+	document += "\n"
+	document += "Sing† the wrath  \n"
+	document += "of “Achilles”.\n"
+	document += "\n"
+	document += "†Or tell\n"
+	document += "\n"
+	document += "\n"
+	document += "    “Rage, goddess.”\n"
+
+	coll, err := Import(document)
+	if err != nil || len(coll) != 3 {
+		fmt.Println(err)
+		t.FailNow()
+	}
+
+	span := func(sp Span) string {
+		return fmt.Sprintf("%d:%d-%d:%d %q", sp.Start.Line, sp.Start.Column,
+			sp.End.Line, sp.End.Column, document[sp.Start.Offset:sp.End.Offset])
+	}
+	head := coll[0].(*Header)
+	para := coll[1].(*Paragraph)
+	quote := coll[2].(*BlockQuote)
+	actual := []string{
+		span(head.Span),
+		span(head.Elements[1].(*Emphasis).Span),
+		span(head.Elements[2].(*Footnote).Span),
+		span(para.Span),
+		span(para.Elements[1].(*Footnote).Span),
+		span(para.Elements[1].(*Footnote).Elements[0].(*Text).Span),
+		span(para.Elements[3].(*LineBreak).Span),
+		span(para.Elements[5].(*InlineQuote).Span),
+		span(quote.Span),
+		span(quote.Paragraphs[0].Span),
+	}
+	expected := []string{
+		`1:1-3:12 "# Book _Α_† #\n\n†Head note."`,
+		`1:9-1:10 "Α"`,
+		`3:1-3:12 "†Head note."`,
+		`5:1-8:9 "Sing† the wrath  \nof “Achilles”.\n\n†Or tell"`,
+		`8:1-8:9 "†Or tell"`,
+		`8:2-8:9 "Or tell"`,
+		`5:16-5:18 "  "`,
+		`6:4-6:14 "“Achilles”"`,
+		`11:5-11:21 "“Rage, goddess.”"`,
+		`11:6-11:20 "Rage, goddess."`,
+	}
+	if !compareStrings(actual, expected) {
+		printComparedStrings(strings.Join(actual, "\n"), strings.Join(expected, "\n"))
+		t.Fail()
+	}
+}
+
+type recordingVisitor struct {
+	events []string
+}
+
+func (rv *recordingVisitor) name(nn Node) string {
+	switch nn.(type) {
+	case *Text:
+		return nn.(*Text).Content()
+	case *Emphasis:
+		return "_" + nn.(*Emphasis).Content() + "_"
+	}
+	return strings.TrimPrefix(fmt.Sprintf("%T", nn), "*process.")
+}
+
+func (rv *recordingVisitor) Enter(nn Node) error {
+	rv.events = append(rv.events, "+"+rv.name(nn))
+	if _, ok := nn.(*Footnote); ok {
+		return SkipChildren
+	}
+	return nil
+}
+
+func (rv *recordingVisitor) Leave(nn Node) error {
+	rv.events = append(rv.events, "-"+rv.name(nn))
+	return nil
+}
+
+func TestWalk(t *testing.T) {
+	document := "# Book _Α_ #\n"
+	document += "\n"
+	document += "Sing† of “Achilles ‖ Hom.”\n"
+	document += "\n"
+	document += "†Or tell\n"
+	document += "\n"
+	document += "\n"
+	document += "    “Rage.”\n"
+
+	coll, err := Import(document)
+	if err != nil {
+		fmt.Println(err)
+		t.FailNow()
+	}
+
+	rv := &recordingVisitor{}
+	if err = Walk(coll, rv); err != nil {
+		fmt.Println(err)
+		t.FailNow()
+	}
+	expected := []string{"+Header", "+Book", "-Book", "+_Α_", "-_Α_", "-Header",
+		"+Paragraph", "+Sing", "-Sing", "+Footnote", "-Footnote",
+		"+of", "-of", "+InlineQuote", "+Achilles", "-Achilles", "-InlineQuote", "-Paragraph",
+		"+BlockQuote", "+Paragraph", "+Rage.", "-Rage.", "-Paragraph", "-BlockQuote"}
+	if !compareStrings(rv.events, expected) {
+		printComparedStrings(strings.Join(rv.events, " "), strings.Join(expected, " "))
+		t.Fail()
+	}
+
+	citations := []string{}
+	notes := 0
+	Walk(coll, VisitFunc(func(nn Node) error {
+		switch nn.(type) {
+		case *InlineQuote:
+			citations = append(citations, nn.(*InlineQuote).Citation)
+		case *Footnote:
+			notes++
+		}
+		return nil
+	}))
+	if !compareStrings(citations, []string{"Hom."}) || notes != 1 {
+		fmt.Println(citations, notes)
+		t.Fail()
+	}
+
+	stop := errors.New("Stop")
+	visited := 0
+	err = Walk(coll, VisitFunc(func(nn Node) error {
+		visited++
+		return stop
+	}))
+	if err != stop || visited != 1 {
+		t.Fail()
+	}
+
+	bad := []Collection{&Paragraph{Block{Elements: []Element{&footnoteRef{1, "1"}}}}}
+	if Walk(bad, VisitFunc(func(Node) error { return nil })) == nil {
+		t.Fail()
+	}
+}
+
+func TestEditing(t *testing.T) {
+	document := "Sing the wrath  \n"
+	document += "of “Achilles, son of Peleus”.\n"
+	document += "\n"
+	document += "    “Rage, goddess.”\n"
+	document += "\n"
+	document += "Between.\n"
+	document += "\n"
+	document += "    “Sing.”\n"
+	document += "\n"
+	document += "    Hom. Il. 1.1\n"
+
+	coll, err := Import(document)
+	if err != nil || len(coll) != 4 {
+		fmt.Println(err)
+		t.FailNow()
+	}
+	para := coll[0].(*Paragraph)
+
+	foot, err := NewFootnote(NewText("Or"), NewEmphasis("tell", true, false))
+	if err != nil || para.WordCount() != 9 {
+		fmt.Println(err, para.WordCount())
+		t.FailNow()
+	}
+	if para.InsertAfterWord(2, foot) != nil {
+		t.FailNow()
+	}
+	left, _ := NewLeftnote(NewText("Hero"))
+	if para.InsertBeforeWord(5, left) != nil {
+		t.FailNow()
+	}
+	right, _ := NewRightnote(NewText("Father"))
+	if para.InsertAfterWord(8, right) != nil {
+		t.FailNow()
+	}
+	expected := []string{"        Sing the† wrath  ", "", "†Or _tell_", "",
+		"˙Hero   of “˙Achilles, son of Peleus˚”.   ˚Father"}
+	if !compareStrings(para.ToStrings(), expected) {
+		printComparedStrings(strings.Join(para.ToStrings(), "\n"), strings.Join(expected, "\n"))
+		t.Fail()
+	}
+
+	moved, err := para.MoveToRight(left)
+	if err != nil || para.Remove(right) != nil || para.Remove(right) == nil {
+		fmt.Println(err)
+		t.FailNow()
+	}
+	expected = []string{"Sing the† wrath  ", "", "†Or _tell_", "",
+		"of “Achilles,˚ son of Peleus”.   ˚Hero"}
+	if !compareStrings(para.ToStrings(), expected) {
+		printComparedStrings(strings.Join(para.ToStrings(), "\n"), strings.Join(expected, "\n"))
+		t.Fail()
+	}
+	if _, err = para.MoveToLeft(moved); err != nil {
+		t.FailNow()
+	}
+
+	rest, err := para.SplitAt(para.Elements[3].(*LineBreak))
+	if err != nil || len(para.Elements) != 3 || rest.Start.Offset != 16 || para.End.Offset != 14 {
+		fmt.Println(err, para.Elements, rest.Span, para.Span)
+		t.FailNow()
+	}
+	if !compareStrings(rest.ToStrings(), []string{"˙Hero   of “˙Achilles, son of Peleus”."}) {
+		fmt.Println(rest.ToStrings())
+		t.Fail()
+	}
+
+	quote, other := coll[1].(*BlockQuote), coll[3].(*BlockQuote)
+	if quote.Merge(other) != nil || quote.Merge(other) == nil {
+		t.FailNow()
+	}
+	expected = []string{"    “Rage, goddess.", "", "    Sing.”", "", "    Hom. Il. 1.1"}
+	if !compareStrings(quote.ToStrings(), expected) || quote.End.Line != 10 {
+		printComparedStrings(strings.Join(quote.ToStrings(), "\n"), strings.Join(expected, "\n"))
+		t.Fail()
+	}
+
+	iq := rest.Elements[1].(*InlineQuote)
+	if rest.Replace(iq.Elements[0], &InlineQuote{}) == nil || rest.InsertAfterWord(9, foot) == nil ||
+		rest.InsertAfterWord(0, foot) == nil {
+		t.Fail()
+	}
+	bad := &Footnote{}
+	bad.Elements = append(bad.Elements, &LineBreak{})
+	if rest.InsertAfterWord(1, bad) == nil {
+		t.Fail()
+	}
+	if _, err = NewFootnote(&LineBreak{}); err == nil {
+		t.Fail()
+	}
+}
+
+func TestJson(t *testing.T) {
+	document := "# Book _Α_† #\n"
+	document += "\n"
+	document += "†Head **note**.\n"
+	document += "\n"
+	document += "˙Left   ˙Sing the wrath  \n"
+	document += "        of “Achilles˚ ‖ Hom.”.   ˚Right\n"
+	document += "\n"
+	document += "    “Rage, <goddess>.”\n"
+	document += "\n"
+	document += "    Hom. Il. 1.1\n"
+
+	coll, err := Import(document)
+	if err != nil {
+		fmt.Println(err)
+		t.FailNow()
+	}
+	output, err := JsonDocument(coll)
+	if err != nil {
+		fmt.Println(err)
+		t.FailNow()
+	}
+	for _, expected := range []string{"\"format\": \"marginalia\"", "\"version\": 1", "\"type\": \"leftnote\"",
+		"\"content\": \"Rage, <goddess>.\"", "\"citation\": \"Hom.\"", "\"id\": \"book-a\""} {
+		if !strings.Contains(output, expected) {
+			fmt.Println(expected)
+			t.Fail()
+		}
+	}
+
+	loaded, err := ImportJson(output)
+	if err != nil {
+		fmt.Println(err)
+		t.FailNow()
+	}
+	if collectionHtml(loaded) != collectionHtml(coll) {
+		printComparedStrings(collectionHtml(loaded), collectionHtml(coll))
+		t.Fail()
+	}
+	spans, expectedSpans := documentSpans(loaded), documentSpans(coll)
+	if len(spans) != len(expectedSpans) || *spans[1] != *expectedSpans[1] {
+		t.Fail()
+	}
+	again, _ := JsonDocument(loaded)
+	if again != output {
+		printComparedStrings(again, output)
+		t.Fail()
+	}
+
+	for _, bad := range []string{
+		"{\"format\": \"marginalia\", \"version\": 2, \"collections\": []}",
+		"{\"format\": \"other\", \"version\": 1, \"collections\": []}",
+		"{\"format\": \"marginalia\", \"version\": 1, \"collections\": [{\"type\": \"table\"}]}",
+		"{\"format\": \"marginalia\", \"version\": 1, \"collections\": [{\"type\": \"header\"}]}",
+		"{\"format\": \"marginalia\", \"version\": 1, \"collections\": [{\"type\": \"paragraph\", " +
+			"\"elements\": [{\"type\": \"footnote\", \"elements\": [{\"type\": \"linebreak\"}]}]}]}",
+		"{\"format\": \"marginalia\"",
+	} {
+		if _, err = ImportJson(bad); err == nil {
+			fmt.Println(bad)
+			t.Fail()
+		}
+	}
+}
+
+func TestTei(t *testing.T) {
+	document := "# Book _One_ #\n"
+	document += "\n"
+	document += "Intro.\n"
+	document += "\n"
+	document += "## Part & **more** ##\n"
+	document += "\n"
+	document += "˙Left   ˙Sing the† wrath  \n"
+	document += "        of “Achilles˚ ‖ Hom.”.   ˚Right\n"
+	document += "\n"
+	document += "†Or tell\n"
+	document += "\n"
+	document += "\n"
+	document += "    “Rage.”\n"
+	document += "\n"
+	document += "    Hom. Il. 1.1\n"
+	document += "\n"
+	document += "# Two #\n"
+
+	coll, err := Import(document)
+	if err != nil {
+		fmt.Println(err)
+		t.FailNow()
+	}
+	output, err := TeiDocument(coll)
+	if err != nil {
+		fmt.Println(err)
+		t.FailNow()
+	}
+
+	expected := "<div type=\"edition\">\n"
+	expected += "<div type=\"textpart\" xml:id=\"book-one\">\n"
+	expected += "<head>Book <hi rend=\"italic\">One</hi></head>\n"
+	expected += "<p>Intro.</p>\n"
+	expected += "<div type=\"textpart\" xml:id=\"part-more\">\n"
+	expected += "<head>Part &amp; <hi rend=\"bold\">more</hi></head>\n"
+	expected += "<p><note place=\"margin-left\">Left</note>Sing the<note place=\"foot\">Or tell</note> wrath\n"
+	expected += "<lb/>of <cit><q>Achilles<note place=\"margin-right\">Right</note></q> <bibl>Hom.</bibl></cit>.</p>\n"
+	expected += "<cit>\n"
+	expected += "<quote>\n"
+	expected += "<p>Rage.</p>\n"
+	expected += "</quote>\n"
+	expected += "<bibl>Hom. Il. 1.1</bibl>\n"
+	expected += "</cit>\n"
+	expected += "</div>\n"
+	expected += "</div>\n"
+	expected += "<div type=\"textpart\" xml:id=\"two\">\n"
+	expected += "<head>Two</head>\n"
+	expected += "</div>\n"
+	expected += "</div>\n"
+	expected += "</body>\n"
+	expected += "</text>\n"
+	expected += "</TEI>"
+
+	if !strings.Contains(output, "<title>Book One</title>") ||
+		!strings.HasSuffix(output, "\n"+expected) {
+		printComparedStrings(output, expected)
+		t.Fail()
+	}
+
+	decoder := xml.NewDecoder(strings.NewReader(output))
+	for {
+		_, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Println(err)
+			t.FailNow()
+		}
+	}
+}
+
+func TestReadmeSidenotes(t *testing.T) {
+	data, err := os.ReadFile("../README.md")
+	if err != nil {
+		t.Skip("README.md not found")
+	}
+	readme := string(data)
+	start := strings.Index(readme, "### Sidenotes\n\n") + len("### Sidenotes\n\n")
+	end := strings.Index(readme, "### Quotations")
+	example := []string{}
+	for _, ll := range strings.Split(readme[start:end], "\n") {
+		example = append(example, strings.TrimPrefix(ll, "    "))
+	}
+
+	coll, err := Import(strings.Join(example, "\n"))
+	if err != nil || len(coll) != 2 {
+		fmt.Println(err)
+		t.FailNow()
+	}
+
+	notes := []string{}
+	Walk(coll, VisitFunc(func(nn Node) error {
+		switch nn.(type) {
+		case *Leftnote:
+			notes = append(notes, dot+nn.(*Leftnote).ToText())
+		case *Rightnote:
+			notes = append(notes, ring+nn.(*Rightnote).ToText())
+		case *Text:
+			if strings.Contains(nn.(*Text).Content(), "  ") {
+				fmt.Println(nn.(*Text).Content())
+				t.Fail()
+			}
+		}
+		return nil
+	}))
+	expected := []string{"˙_1_", "˙Slightly more complex sidenote", "˙3", "˚Ring example"}
+	if !compareStrings(notes, expected) {
+		fmt.Println(notes)
+		t.Fail()
+	}
+}
+
+func TestCrlf(t *testing.T) {
+	document := "# Book #\n"
+	document += "\n"
+	document += "Sing† the wrath  \n"
+	document += "of Achilles˚       ˚Peleus' son\n"
+	document += "\n"
+	document += "†Or tell\n"
+	document += "\n"
+	document += "\n"
+	document += "A *bad\n"
+	crlf := strings.ReplaceAll(document, "\n", "\r\n")
+
+	expected, expectedErr := Import(document)
+	coll, err := Import(crlf)
+	if collectionHtml(coll) != collectionHtml(expected) {
+		printComparedStrings(collectionHtml(coll), collectionHtml(expected))
+		t.Fail()
+	}
+	if err == nil || err.Error() != expectedErr.Error() || err.Error() != "9:3: Unclosed emphasis" {
+		fmt.Println(err)
+		t.Fail()
+	}
+
+	importer := ImportReader(strings.NewReader(crlf))
+	streamed := []Collection{}
+	for {
+		cc, err := importer.Next()
+		if err == io.EOF {
+			break
+		}
+		if cc != nil {
+			streamed = append(streamed, cc)
+		}
+	}
+	if collectionHtml(streamed) != collectionHtml(expected) {
+		printComparedStrings(collectionHtml(streamed), collectionHtml(expected))
+		t.Fail()
+	}
+
+	if _, err = Import("A stray\r carriage return\r\n"); err == nil || err.Error() != "1:8: Control character in text" {
+		fmt.Println(err)
+		t.Fail()
+	}
+}
+
+func TestIntrawordDelimiters(t *testing.T) {
+	cases := [][]string{
+		{"un*believ*able", "<p>un*believ*able</p>", "un*believ*able"},
+		{"ἄνδρ*α* μοι", "<p>ἄνδρ*α* μοι</p>", "ἄνδρ*α\\* μοι"},
+		{"a*b*c", "<p>a*b*c</p>", "a*b*c"},
+		{"snake_case_name", "<p>snake_case_name</p>", "snake_case_name"},
+		{"an *emphasised* word", "<p>an <em>emphasised</em> word</p>", "an _emphasised_ word"},
+	}
+	for _, cc := range cases {
+		coll, err := Import(cc[0])
+		if err != nil || len(coll) != 1 {
+			fmt.Println(cc[0], err)
+			t.Fail()
+			continue
+		}
+		if coll[0].ToHtml() != cc[1] || coll[0].ToStrings()[0] != cc[2] {
+			fmt.Println(coll[0].ToHtml(), coll[0].ToStrings())
+			t.Fail()
+		}
+		if FlowText(coll, FlowOptions{}) != strings.ReplaceAll(cc[2], "\\", "") &&
+			!strings.Contains(cc[1], "<em>") {
+			fmt.Println(FlowText(coll, FlowOptions{}))
+			t.Fail()
+		}
+		again, err := Import(cc[2])
+		if err != nil || collectionHtml(again) != collectionHtml(coll) {
+			fmt.Println(cc[2], err)
+			t.Fail()
+		}
+	}
+}
+
+func TestTrailingSpaces(t *testing.T) {
+	cases := [][]string{
+		{"our \nfathers", "<p>our fathers</p>"},
+		{"our   \nfathers", "<p>our</br>\nfathers</p>"},
+		{"“Four score and seven years ago our \nfathers brought forth”", "<p><q>Four score and seven years ago our fathers brought forth</q></p>"},
+	}
+	for _, cc := range cases {
+		coll, err := Import(cc[0])
+		if err != nil || len(coll) != 1 || coll[0].ToHtml() != cc[1] {
+			fmt.Println(cc[0], err)
+			if len(coll) == 1 {
+				printComparedStrings(coll[0].ToHtml(), cc[1])
+			}
+			t.Fail()
+		}
+	}
+
+	// The block quote example of the README, whose lines end in spaces
+	document := "    “Four score and seven years ago our \n"
+	document += "    fathers brought forth on this continent \n"
+	document += "    a new nation, conceived in liberty, \n"
+	document += "    and dedicated to the proposition that \n"
+	document += "    all men are created equal.\n"
+	document += "\n"
+	document += "    Now we are engaged in a great civil \n"
+	document += "    war, testing whether that nation, or \n"
+	document += "    any nation so conceived and so \n"
+	document += "    dedicated, can long endure.”\n"
+	document += "\n"
+	document += "    Abraham Lincoln, G. A. \n"
+	document += "\n"
+	document += "Inline quotes are also allowed like with the\n"
+	document += "same technique. “Curly quotes are used to\n"
+	document += "begin and end the quote. ‖ Myself” A unicode\n"
+	document += "double bar is used to cite, if necessary. \n"
+
+	coll, err := Import(document)
+	if err != nil {
+		fmt.Println(err)
+		t.FailNow()
+	}
+	found := false
+	Walk(coll, VisitFunc(func(nn Node) error {
+		if tt, ok := nn.(*Text); ok {
+			found = found || strings.Contains(tt.Content(), "our fathers")
+			if strings.Contains(tt.Content(), "  ") {
+				fmt.Println(tt.Content())
+				t.Fail()
+			}
+		}
+		return nil
+	}))
+	if !found {
+		t.Fail()
+	}
+}
+
+func TestReformatFixedPoint(t *testing.T) {
+	documents := []string{
+		"** **,gamma****",
+		"alphagamma\n** *.*,“",
+		"*_ beta,*",
+		"# \n.",
+		"x\n\n   ",
+		"    \n\nx",
+		"*a.a* _,  beta_",
+		"a\\\n\\#b",
+		"˙Left   Sing the ˙#wrath.",
+		"Sing˚ #the wrath.   ˚Right",
+		"A line that wrapped \\#5 and \\*stars\\*.",
+	}
+	for _, jj := range []Justification{{}, {Width: 20, NoteWidth: 10}} {
+		for _, document := range documents {
+			once, err := Reformat(document, jj)
+			if err != nil {
+				fmt.Println(document, err)
+				t.Fail()
+				continue
+			}
+			twice, err := Reformat(once, jj)
+			if err != nil || twice != once {
+				fmt.Printf("%q %v\n", document, err)
+				printComparedStrings(twice, once)
+				t.Fail()
+			}
+		}
+	}
+
+	expected := map[string]string{
+		"** **,gamma****": "\\*\\***,gamma** **",
+		"*_ beta,*":       "_\\_ beta,_",
+		"# \n.":           "\\# .",
+		"x\n\n   ":        "x",
+	}
+	for document, output := range expected {
+		if once, _ := Reformat(document, Justification{}); once != output {
+			printComparedStrings(once, output)
+			t.Fail()
+		}
+	}
+}
+
+func BenchmarkImportParagraph(b *testing.B) {
+	document := strings.Repeat("Sing, goddess, the wrath of Achilles, son of Peleus,\n", 2000)
+	for ii := 0; ii < b.N; ii++ {
+		if _, err := Import(document); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestEditingSpans(t *testing.T) {
+	coll, err := Import("Sing the wrath of Achilles.\n\nSing the wrath\nof Achilles.\n")
+	if err != nil || len(coll) != 2 {
+		fmt.Println(err)
+		t.FailNow()
+	}
+	foot, _ := NewFootnote(NewText("Or tell"))
+
+	para := coll[0].(*Paragraph)
+	if para.InsertAfterWord(2, foot) != nil || len(para.Elements) != 3 {
+		t.FailNow()
+	}
+	head, tail := para.Elements[0].(*Text), para.Elements[2].(*Text)
+	if head.Content() != "Sing the" || head.Span != (Span{Position{1, 1, 0}, Position{1, 9, 8}}) ||
+		tail.Content() != "wrath of Achilles." || tail.Span != (Span{Position{1, 10, 9}, Position{1, 28, 27}}) {
+		fmt.Println(head.Span, tail.Span)
+		t.Fail()
+	}
+
+	// Text joined from two lines keeps the span of the whole
+	para = coll[1].(*Paragraph)
+	whole := para.Elements[0].(*Text).Span
+	if para.InsertAfterWord(3, foot) != nil || len(para.Elements) != 3 {
+		t.FailNow()
+	}
+	if para.Elements[0].(*Text).Span != whole || para.Elements[2].(*Text).Span != whole {
+		fmt.Println(para.Elements[0].(*Text).Span, para.Elements[2].(*Text).Span, whole)
+		t.Fail()
+	}
+
+	// A note that cannot be moved is put back where it was
+	left, _ := NewLeftnote(NewText("Hero"))
+	if para.InsertBeforeWord(2, left) != nil {
+		t.FailNow()
+	}
+	left.Elements = append(left.Elements, &LineBreak{})
+	before := append([]Element{}, para.Elements...)
+	if moved, err := para.MoveToRight(left); err == nil || moved != nil {
+		t.Fail()
+	}
+	if len(para.Elements) != len(before) {
+		t.FailNow()
+	}
+	for ii := range before {
+		if para.Elements[ii] != before[ii] {
+			fmt.Println(para.Elements)
+			t.Fail()
+		}
+	}
+}
+
+func TestNoteQuotes(t *testing.T) {
+	text := "The wrath† of Achilles˚.   ˚Or “rage ‖ LSJ”\n\n†As Homer says, “μῆνιν ἄειδε ‖ Il. 1.1”.\n"
+	coll, err := Import(text)
+	if err != nil {
+		fmt.Println(err)
+		t.FailNow()
+	}
+
+	html, err := HtmlDocument(coll, HtmlOptions{})
+	if err != nil || !strings.Contains(html, `<span class="footnote">†As Homer says, <q cite="Il. 1.1">μῆνιν ἄειδε</q>.</span>`) {
+		fmt.Println(html, err)
+		t.Fail()
+	}
+	if _, err := HtmlDocument(coll, HtmlOptions{Profile: MarginProfile}); err != nil {
+		fmt.Println(err)
+		t.Fail()
+	}
+	if _, err := JsonDocument(coll); err != nil {
+		fmt.Println(err)
+		t.Fail()
+	}
+	tei, err := TeiDocument(coll)
+	if err != nil || !strings.Contains(tei, "<cit><q>rage</q> <bibl>LSJ</bibl></cit>") {
+		fmt.Println(tei, err)
+		t.Fail()
+	}
+	if flow := FlowText(coll, FlowOptions{NoteNumbers: true}); !strings.Contains(flow, "“μῆνιν ἄειδε”") {
+		fmt.Println(flow)
+		t.Fail()
+	}
+
+	jj := Justification{Width: 30, NoteWidth: 12}
+	once, err := Reformat(text, jj)
+	if err != nil || !strings.Contains(once, "“μῆνιν ἄειδε ‖") {
+		fmt.Println(once, err)
+		t.FailNow()
+	}
+	if twice, err := Reformat(once, jj); err != nil || twice != once {
+		fmt.Println(twice, err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,494 @@
+package process
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Inline text is read in three steps. The lines of a paragraph are
+// split into tokens, emphasis delimiters are matched, and the tokens are
+// gathered into elements.
+//
+//   **strong** __strong__ *em* _em_ ***both***
+//
+// A backslash before *, _, # or \ makes it a literal character. Only a
+// hash that starts a line needs one, to keep it from opening a header.
+
+const (
+	tokenLetter = iota
+	tokenDelimiter
+	tokenElement
+	tokenLquo
+	tokenRquo
+	tokenCitation
+	tokenCite
+)
+
+type inlineToken struct {
+	kind    int
+	at      sourceText
+	element Element
+	// Index of the quotation the token is in, or 0 outside one
+	scope  int
+	strong int
+	em     int
+	used   bool
+	// An escaped letter is never mark-up
+	escaped bool
+}
+
+func (tk inlineToken) letter() rune {
+	rr, _ := utf8.DecodeRuneInString(tk.at.text)
+	return rr
+}
+
+// A run of the same delimiter. The tokens [first, last] are those not
+// yet used to open or close emphasis.
+type delimiterRun struct {
+	letter   rune
+	first    int
+	last     int
+	canOpen  bool
+	canClose bool
+	scope    int
+	// The closing quote of the quotation an opener was left in
+	stranded int
+}
+
+func (dr *delimiterRun) count() int {
+	return dr.last - dr.first + 1
+}
+
+func isDelimiter(rr rune) bool {
+	return rr == '*' || rr == '_'
+}
+
+func isEscapable(rr rune) bool {
+	return rr == '*' || rr == '_' || rr == '\\' || rr == '#'
+}
+
+func tokenizeInline(input []intermediates) ([]inlineToken, error) {
+	tokens := []inlineToken{}
+	addLetter := func(at sourceText, kind int) {
+		tokens = append(tokens, inlineToken{kind: kind, at: at})
+	}
+
+	for ii, ll := range input {
+		if ii != 0 {
+			addLetter(madeUp(" "), tokenLetter)
+		}
+		switch ll.(type) {
+		default:
+			return tokens, errors.New("makeText: Unexpected type")
+		case *Footnote, *Leftnote, *Rightnote, *InlineQuote:
+			tokens = append(tokens, inlineToken{kind: tokenElement, element: ll.(Element)})
+		case sourceText, string:
+			ss, _ := asSource(ll)
+			newline := false
+			breakSpan := unknownSpan()
+			if hasLineBreak(ss.text) {
+				breakSpan = sourceSpan(ss.slice(len(ss.text)-2, len(ss.text)))
+				ss = ss.slice(0, len(ss.text)-2)
+				newline = true
+			}
+			// Lines are joined by one space whatever they end with
+			ss = ss.trimRight(" ")
+			for idx := 0; idx < len(ss.text); {
+				letter, size := utf8.DecodeRuneInString(ss.text[idx:])
+				here := ss.slice(idx, idx+size)
+				next, nextSize := utf8.DecodeRuneInString(ss.text[idx+size:])
+				switch {
+				case letter == '\\' && isEscapable(next):
+					tokens = append(tokens, inlineToken{kind: tokenLetter,
+						at: ss.slice(idx+size, idx+size+nextSize), escaped: true})
+					size += nextSize
+				case isDelimiter(letter):
+					addLetter(here, tokenDelimiter)
+				case string(letter) == lquo:
+					addLetter(here, tokenLquo)
+				case string(letter) == rquo:
+					addLetter(here, tokenRquo)
+				case string(letter) == citation:
+					addLetter(here, tokenCitation)
+				default:
+					addLetter(here, tokenLetter)
+				}
+				idx += size
+			}
+			if newline {
+				tokens = append(tokens, inlineToken{kind: tokenElement, element: &LineBreak{breakSpan}})
+			}
+		}
+	}
+
+	return tokens, nil
+}
+
+// Decide which quotation marks open and close an InlineQuote. Marks
+// nested inside a quotation are text, as is the citation of one, and a
+// quotation that is never closed is only text.
+func scopeQuotes(tokens []inlineToken) {
+	scope := 0
+	open := -1
+	nested := 0
+	citing := false
+	for ii := range tokens {
+		tk := &tokens[ii]
+		switch {
+		case citing && tk.kind != tokenRquo:
+			tk.kind = tokenCite
+		case tk.kind == tokenLquo && open != -1:
+			nested++
+			tk.kind = tokenLetter
+		case tk.kind == tokenRquo && nested != 0:
+			nested--
+			tk.kind = tokenLetter
+		case tk.kind == tokenLquo:
+			scope++
+			open = ii
+		case tk.kind == tokenRquo && open != -1:
+			tk.scope = scope
+			open = -1
+			citing = false
+			continue
+		case tk.kind == tokenRquo:
+			tk.kind = tokenLetter
+		case tk.kind == tokenCitation && open != -1:
+			citing = true
+		case tk.kind == tokenCitation:
+			tk.kind = tokenLetter
+		}
+		if open != -1 {
+			tk.scope = scope
+		}
+	}
+
+	if open != -1 {
+		for ii := open; ii < len(tokens); ii++ {
+			switch tokens[ii].kind {
+			case tokenLquo, tokenCitation:
+				tokens[ii].kind = tokenLetter
+			case tokenCite:
+				tokens[ii].kind = tokenLetter
+				if isDelimiter(tokens[ii].letter()) {
+					tokens[ii].kind = tokenDelimiter
+				}
+			}
+			tokens[ii].scope = 0
+		}
+	}
+}
+
+// The letter beside a delimiter run, where anything that is not a
+// letter, such as a note, counts as punctuation
+func neighbour(tokens []inlineToken, ii int) rune {
+	if ii < 0 || ii >= len(tokens) {
+		return ' '
+	}
+	switch tokens[ii].kind {
+	case tokenLetter, tokenDelimiter, tokenCite:
+		return tokens[ii].letter()
+	case tokenElement:
+		if _, ok := tokens[ii].element.(*LineBreak); ok {
+			return ' '
+		}
+	}
+	return '.'
+}
+
+// A delimiter run opens emphasis when text follows it and closes emphasis
+// when text comes before it. A delimiter inside a word is only text,
+// since emphasis is always set apart from the text around it.
+func flanking(before, after rune) (bool, bool) {
+	canOpen := !unicode.IsSpace(after)
+	canClose := !unicode.IsSpace(before)
+	if isWordLetter(before) && isWordLetter(after) {
+		return false, false
+	}
+	return canOpen, canClose
+}
+
+func isWordLetter(rr rune) bool {
+	return unicode.IsLetter(rr) || unicode.IsDigit(rr)
+}
+
+func delimiterRuns(tokens []inlineToken) []*delimiterRun {
+	runs := []*delimiterRun{}
+	for ii := 0; ii < len(tokens); ii++ {
+		if tokens[ii].kind != tokenDelimiter {
+			continue
+		}
+		run := &delimiterRun{letter: tokens[ii].letter(), first: ii, scope: tokens[ii].scope, stranded: -1}
+		for ii+1 < len(tokens) && tokens[ii+1].kind == tokenDelimiter &&
+			tokens[ii+1].letter() == run.letter {
+			ii++
+		}
+		run.last = ii
+		run.canOpen, run.canClose = flanking(neighbour(tokens, run.first-1), neighbour(tokens, run.last+1))
+		runs = append(runs, run)
+	}
+	return runs
+}
+
+// Match delimiter runs, marking the tokens each pair encloses as strong
+// or em and the delimiters they use as used
+func matchEmphasis(tokens []inlineToken) error {
+	errs := ErrorList{}
+	openers := []*delimiterRun{}
+	stranded := []*delimiterRun{}
+	lquos := map[int]int{}
+
+	unclosed := func(runs []*delimiterRun) {
+		for _, run := range runs {
+			if !run.canClose {
+				errs.add(newParseError(ErrUnclosedEmphasis, "Unclosed emphasis", tokens[run.first].at))
+			}
+		}
+	}
+
+	// Emphasis opened outside a quotation and closed inside it, or the
+	// other way round, is reported at the quotation mark it crosses
+	crossing := func(closer *delimiterRun) {
+		for kk := len(openers) - 1; kk >= 0; kk-- {
+			if openers[kk].letter == closer.letter && openers[kk].scope != closer.scope {
+				errs.add(newParseError(ErrEmphasisInQuote, "Emphasis crosses quotation",
+					tokens[lquos[closer.scope]].at))
+				openers = append(openers[:kk], openers[kk+1:]...)
+				return
+			}
+		}
+		for kk := len(stranded) - 1; kk >= 0; kk-- {
+			if stranded[kk].letter == closer.letter {
+				errs.add(newParseError(ErrEmphasisInQuote, "Emphasis crosses quotation",
+					tokens[stranded[kk].stranded].at))
+				stranded = append(stranded[:kk], stranded[kk+1:]...)
+				return
+			}
+		}
+	}
+
+	closeRun := func(closer *delimiterRun) {
+		matched := false
+		for closer.count() > 0 {
+			found := -1
+			for kk := len(openers) - 1; kk >= 0; kk-- {
+				if openers[kk].letter == closer.letter && openers[kk].scope == closer.scope {
+					found = kk
+					break
+				}
+			}
+			if found == -1 {
+				if !matched && !closer.canOpen {
+					crossing(closer)
+				}
+				return
+			}
+			matched = true
+
+			opener := openers[found]
+			unclosed(openers[found+1:])
+			openers = openers[:found+1]
+
+			nn := 1
+			if opener.count() >= 2 && closer.count() >= 2 {
+				nn = 2
+			}
+			for ii := opener.last + 1; ii < closer.first; ii++ {
+				if nn == 2 {
+					tokens[ii].strong++
+				} else {
+					tokens[ii].em++
+				}
+			}
+			for kk := 0; kk < nn; kk++ {
+				tokens[opener.last-kk].used = true
+				tokens[closer.first+kk].used = true
+			}
+			opener.last -= nn
+			closer.first += nn
+			if opener.count() == 0 {
+				openers = openers[:found]
+			}
+		}
+	}
+
+	runs := delimiterRuns(tokens)
+	next := 0
+	for ii, tk := range tokens {
+		switch tk.kind {
+		case tokenLquo:
+			lquos[tk.scope] = ii
+		case tokenRquo:
+			kept := []*delimiterRun{}
+			for _, run := range openers {
+				if run.scope == tk.scope {
+					run.stranded = ii
+					stranded = append(stranded, run)
+				} else {
+					kept = append(kept, run)
+				}
+			}
+			openers = kept
+		}
+		if next == len(runs) || runs[next].first != ii {
+			continue
+		}
+		run := runs[next]
+		next++
+		if run.canClose {
+			closeRun(run)
+		}
+		if run.canOpen && run.count() > 0 {
+			openers = append(openers, run)
+		}
+	}
+	unclosed(openers)
+	unclosed(stranded)
+
+	return errs.err()
+}
+
+// Return paragraph elements
+func makeText(input []intermediates) ([]Element, error) {
+	// Emphasis is preserved across notes, linebreaks;
+	// it is an error when it crosses a quote
+	// Linebreaks are ignored unless they follow two spaces
+
+	errs := ErrorList{}
+	tokens, err := tokenizeInline(input)
+	if err != nil {
+		return []Element{}, err
+	}
+	scopeQuotes(tokens)
+	errs.add(matchEmphasis(tokens))
+
+	output := []Element{}
+
+	// Elements go into the open inline quote, if there is one
+	target := &output
+	var quote *InlineQuote
+	cite := ""
+
+	text := &sourceBuilder{}
+	strong := false
+	em := false
+	addText := func() {
+		ss := text.source().trim(" \n")
+		if len(ss.text) != 0 {
+			if strong || em {
+				*target = append(*target, &Emphasis{Text{ss.text, sourceSpan(ss)}, em, strong})
+			} else {
+				*target = append(*target, &Text{ss.text, sourceSpan(ss)})
+			}
+		}
+		text = &sourceBuilder{}
+	}
+
+	for _, tk := range tokens {
+		switch tk.kind {
+		case tokenElement:
+			addText()
+			*target = append(*target, tk.element)
+		case tokenLquo:
+			addText()
+			quote = &InlineQuote{}
+			quote.Span = sourceSpan(tk.at)
+			target = &quote.Elements
+		case tokenCitation:
+			addText()
+		case tokenCite:
+			cite += tk.at.text
+		case tokenRquo:
+			addText()
+			quote.Citation = strings.Trim(cite, " ")
+			quote.cover(sourceSpan(tk.at))
+			output = append(output, quote)
+			target = &output
+			quote = nil
+			cite = ""
+		case tokenLetter, tokenDelimiter:
+			if tk.used {
+				continue
+			}
+			if isMarkup(tk.letter()) && !tk.escaped {
+				errs.add(newParseError(ErrMisplacedMarkup, "Misplaced "+tk.at.text, tk.at))
+			}
+			if (tk.strong != 0) != strong || (tk.em != 0) != em {
+				addText()
+				strong, em = tk.strong != 0, tk.em != 0
+			}
+			text.add(tk.at)
+		}
+	}
+	addText()
+
+	return output, errs.err()
+}
+
+// The literal delimiters and backslashes of text are marked with
+// control characters, which documents cannot hold, until the line they
+// are written on is known, since a delimiter runs on with the mark-up
+// beside it
+var literalMarks = strings.NewReplacer("*", "\x01", "_", "\x02", "\\", "\x03")
+
+func markLiterals(ss string) string {
+	return literalMarks.Replace(ss)
+}
+
+func unmarkLiteral(rr rune) (rune, bool) {
+	switch rr {
+	case '\x01':
+		return '*', true
+	case '\x02':
+		return '_', true
+	case '\x03':
+		return '\\', true
+	}
+	return rr, false
+}
+
+// Escape the marked backslashes and delimiters of a line that would
+// otherwise be read as mark-up
+func escapeLiterals(ss string) string {
+	if !strings.ContainsAny(ss, "\x01\x02\x03") {
+		return ss
+	}
+	runes := []rune(ss)
+	at := func(ii int) rune {
+		if ii < 0 || ii >= len(runes) {
+			return ' '
+		}
+		rr, _ := unmarkLiteral(runes[ii])
+		return rr
+	}
+
+	output := ""
+	for ii := 0; ii < len(runes); ii++ {
+		rr, literal := unmarkLiteral(runes[ii])
+		switch {
+		case literal && rr == '\\' && isEscapable(at(ii+1)):
+			output += "\\\\"
+		case isDelimiter(rr):
+			last := ii
+			markup := !literal
+			for at(last+1) == rr {
+				last++
+				_, ll := unmarkLiteral(runes[last])
+				markup = markup || !ll
+			}
+			canOpen, canClose := flanking(at(ii-1), at(last+1))
+			for ; ii <= last; ii++ {
+				if _, ll := unmarkLiteral(runes[ii]); ll && (markup || canOpen || canClose) {
+					output += "\\"
+				}
+				output += string(rr)
+			}
+			ii--
+		default:
+			output += string(rr)
+		}
+	}
+	return output
+}
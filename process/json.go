@@ -0,0 +1,328 @@
+package process
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// The document tree as json, for programs that want the structure of a
+// document without reading Marginalia text themselves:
+//
+//   {"format": "marginalia", "version": 1, "collections": [...]}
+//
+// Each node has a "type": "header", "paragraph" or "blockquote" for
+// collections and "text", "emphasis", "linebreak", "footnote",
+// "leftnote", "rightnote" or "inlinequote" for elements. Headers and
+// notes hold "elements", quotations "paragraphs". A node read from the
+// source has a "span" with the "line", "column" and "offset" of its
+// "start" and "end". Fields that are empty are left out. Versions only
+// change when a document would be read differently.
+
+const jsonFormat = "marginalia"
+
+// JsonVersion is the version of the json written by JsonDocument
+const JsonVersion = 1
+
+type jsonPosition struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+	Offset int `json:"offset"`
+}
+
+type jsonSpan struct {
+	Start jsonPosition `json:"start"`
+	End   jsonPosition `json:"end"`
+}
+
+type jsonNode struct {
+	Type       string      `json:"type"`
+	Level      int         `json:"level,omitempty"`
+	Id         string      `json:"id,omitempty"`
+	Content    string      `json:"content,omitempty"`
+	Em         bool        `json:"em,omitempty"`
+	Strong     bool        `json:"strong,omitempty"`
+	Citation   string      `json:"citation,omitempty"`
+	Elements   []*jsonNode `json:"elements,omitempty"`
+	Paragraphs []*jsonNode `json:"paragraphs,omitempty"`
+	Span       *jsonSpan   `json:"span,omitempty"`
+}
+
+type jsonDocument struct {
+	Format      string      `json:"format"`
+	Version     int         `json:"version"`
+	Collections []*jsonNode `json:"collections"`
+}
+
+func toJsonSpan(sp Span) *jsonSpan {
+	if sp.Start.Line == 0 && sp.End.Line == 0 {
+		return nil
+	}
+	return &jsonSpan{jsonPosition(sp.Start), jsonPosition(sp.End)}
+}
+
+func fromJsonSpan(js *jsonSpan) Span {
+	if js == nil {
+		return Span{}
+	}
+	return Span{Position(js.Start), Position(js.End)}
+}
+
+func toJsonElements(elements []Element) ([]*jsonNode, error) {
+	output := []*jsonNode{}
+	for _, ee := range elements {
+		var node *jsonNode
+		var err error
+		switch ee.(type) {
+		default:
+			return output, errors.New("Bad type in Block")
+		case nil:
+			continue
+		case *Text:
+			tt := ee.(*Text)
+			node = &jsonNode{Type: "text", Content: tt.content, Span: toJsonSpan(tt.Span)}
+		case *Emphasis:
+			em := ee.(*Emphasis)
+			node = &jsonNode{Type: "emphasis", Content: em.content, Em: em.Em, Strong: em.Strong,
+				Span: toJsonSpan(em.Span)}
+		case *LineBreak:
+			node = &jsonNode{Type: "linebreak", Span: toJsonSpan(ee.(*LineBreak).Span)}
+		case *Footnote:
+			node = &jsonNode{Type: "footnote", Span: toJsonSpan(ee.(*Footnote).Span)}
+			node.Elements, err = toJsonElements(ee.(*Footnote).Elements)
+		case *Leftnote:
+			node = &jsonNode{Type: "leftnote", Span: toJsonSpan(ee.(*Leftnote).Span)}
+			node.Elements, err = toJsonElements(ee.(*Leftnote).Elements)
+		case *Rightnote:
+			node = &jsonNode{Type: "rightnote", Span: toJsonSpan(ee.(*Rightnote).Span)}
+			node.Elements, err = toJsonElements(ee.(*Rightnote).Elements)
+		case *InlineQuote:
+			iq := ee.(*InlineQuote)
+			node = &jsonNode{Type: "inlinequote", Citation: iq.Citation, Span: toJsonSpan(iq.Span)}
+			node.Elements, err = toJsonElements(iq.Elements)
+		}
+		if err != nil {
+			return output, err
+		}
+		output = append(output, node)
+	}
+	return output, nil
+}
+
+func toJsonParagraph(pp *Paragraph) (*jsonNode, error) {
+	node := &jsonNode{Type: "paragraph", Span: toJsonSpan(pp.Span)}
+	var err error
+	node.Elements, err = toJsonElements(pp.Elements)
+	return node, err
+}
+
+func toJsonCollection(cc Collection) (*jsonNode, error) {
+	if err := Check(cc); err != nil {
+		return nil, err
+	}
+	var node *jsonNode
+	var err error
+	switch cc.(type) {
+	case *Header:
+		hh := cc.(*Header)
+		node = &jsonNode{Type: "header", Level: hh.Level, Id: hh.Id, Span: toJsonSpan(hh.Span)}
+		node.Elements, err = toJsonElements(hh.Elements)
+	case *Paragraph:
+		node, err = toJsonParagraph(cc.(*Paragraph))
+	case *BlockQuote:
+		bq := cc.(*BlockQuote)
+		node = &jsonNode{Type: "blockquote", Citation: bq.Citation, Span: toJsonSpan(bq.Span)}
+		for ii := range bq.Paragraphs {
+			var para *jsonNode
+			para, err = toJsonParagraph(&bq.Paragraphs[ii])
+			if err != nil {
+				break
+			}
+			node.Paragraphs = append(node.Paragraphs, para)
+		}
+	}
+	return node, err
+}
+
+// The document up to its first collection, as encoding/json indents it
+var jsonHead = "{\n  \"format\": " + strconv.Quote(jsonFormat) + ",\n  \"version\": " +
+	strconv.Itoa(JsonVersion) + ",\n  \"collections\": ["
+
+// JsonWriter writes a document as json a collection at a time, the same
+// json as JsonDocument
+type JsonWriter struct {
+	writer io.Writer
+	count  int
+}
+
+func NewJsonWriter(ww io.Writer) *JsonWriter {
+	return &JsonWriter{writer: ww}
+}
+
+func (jw *JsonWriter) Write(cc Collection) error {
+	node, err := toJsonCollection(cc)
+	if err != nil {
+		return err
+	}
+
+	output := bytes.Buffer{}
+	if jw.count == 0 {
+		output.WriteString(jsonHead + "\n    ")
+	} else {
+		output.WriteString(",\n    ")
+	}
+	encoder := json.NewEncoder(&output)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("    ", "  ")
+	if err := encoder.Encode(node); err != nil {
+		return err
+	}
+	output.Truncate(output.Len() - 1)
+	jw.count++
+
+	_, err = jw.writer.Write(output.Bytes())
+	return err
+}
+
+// Close ends the document, which has no newline after it
+func (jw *JsonWriter) Close() error {
+	output := "\n  ]\n}"
+	if jw.count == 0 {
+		output = jsonHead + "]\n}"
+	}
+	_, err := io.WriteString(jw.writer, output)
+	return err
+}
+
+// JsonDocument writes the collections of a document as json
+func JsonDocument(coll []Collection) (string, error) {
+	output := strings.Builder{}
+	jw := NewJsonWriter(&output)
+	for _, cc := range coll {
+		if err := jw.Write(cc); err != nil {
+			return "", err
+		}
+	}
+	if err := jw.Close(); err != nil {
+		return "", err
+	}
+	return output.String(), nil
+}
+
+func fromJsonElements(nodes []*jsonNode) ([]Element, error) {
+	output := []Element{}
+	for _, node := range nodes {
+		if node == nil {
+			return output, errors.New("Missing json node")
+		}
+		span := fromJsonSpan(node.Span)
+		var ee Element
+		var err error
+		switch node.Type {
+		default:
+			return output, errors.New("Unknown json element type: " + node.Type)
+		case "text":
+			ee = &Text{node.Content, span}
+		case "emphasis":
+			ee = &Emphasis{Text{node.Content, span}, node.Em, node.Strong}
+		case "linebreak":
+			ee = &LineBreak{span}
+		case "footnote":
+			ff := &Footnote{}
+			ff.Span = span
+			ff.Elements, err = fromJsonElements(node.Elements)
+			ee = ff
+		case "leftnote":
+			ll := &Leftnote{}
+			ll.Span = span
+			ll.Elements, err = fromJsonElements(node.Elements)
+			ee = ll
+		case "rightnote":
+			rr := &Rightnote{}
+			rr.Span = span
+			rr.Elements, err = fromJsonElements(node.Elements)
+			ee = rr
+		case "inlinequote":
+			iq := &InlineQuote{Citation: node.Citation}
+			iq.Span = span
+			iq.Elements, err = fromJsonElements(node.Elements)
+			ee = iq
+		}
+		if err != nil {
+			return output, err
+		}
+		output = append(output, ee)
+	}
+	return output, nil
+}
+
+func fromJsonParagraph(node *jsonNode) (*Paragraph, error) {
+	if node == nil || node.Type != "paragraph" {
+		return nil, errors.New("Expected a json paragraph")
+	}
+	pp := &Paragraph{}
+	pp.Span = fromJsonSpan(node.Span)
+	var err error
+	pp.Elements, err = fromJsonElements(node.Elements)
+	return pp, err
+}
+
+// ImportJson reads a document written by JsonDocument. Collections that
+// break the rules of the document tree are reported.
+func ImportJson(input string) ([]Collection, error) {
+	doc := jsonDocument{}
+	if err := json.Unmarshal([]byte(input), &doc); err != nil {
+		return []Collection{}, err
+	}
+	if doc.Format != jsonFormat {
+		return []Collection{}, errors.New("Not a marginalia json document")
+	}
+	if doc.Version != JsonVersion {
+		return []Collection{}, errors.New("Unsupported json version " + strconv.Itoa(doc.Version))
+	}
+
+	coll := []Collection{}
+	for _, node := range doc.Collections {
+		if node == nil {
+			return coll, errors.New("Missing json node")
+		}
+		var cc Collection
+		var err error
+		switch node.Type {
+		default:
+			return coll, errors.New("Unknown json collection type: " + node.Type)
+		case "header":
+			hh := &Header{Level: node.Level, Id: node.Id}
+			hh.Span = fromJsonSpan(node.Span)
+			hh.Elements, err = fromJsonElements(node.Elements)
+			if hh.Level < 1 {
+				err = errors.New("Bad header level " + strconv.Itoa(hh.Level))
+			}
+			cc = hh
+		case "paragraph":
+			cc, err = fromJsonParagraph(node)
+		case "blockquote":
+			bq := &BlockQuote{Citation: node.Citation, Span: fromJsonSpan(node.Span)}
+			for _, para := range node.Paragraphs {
+				var pp *Paragraph
+				pp, err = fromJsonParagraph(para)
+				if err != nil {
+					break
+				}
+				bq.AddParagraph(*pp)
+			}
+			cc = bq
+		}
+		if err == nil {
+			err = Check(cc)
+		}
+		if err != nil {
+			return coll, err
+		}
+		coll = append(coll, cc)
+	}
+	return coll, nil
+}
@@ -0,0 +1,405 @@
+package process
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+// Justification sets the channel widths used when laying a document out
+// as Marginalia text. Width is the main text column and NoteWidth the
+// width of the left and right sidenote channels. A Width of zero leaves
+// the main text unwrapped.
+type Justification struct {
+	Width     int
+	NoteWidth int
+}
+
+// Spaces kept between the sidenote channels and the main text
+const channelGap = 3
+
+// Spaces that indent a block quotation
+const quoteIndent = "    "
+
+func runeLen(ss string) int {
+	return utf8.RuneCountInString(ss)
+}
+
+func padRight(ss string, width int) string {
+	if pad := width - runeLen(ss); pad > 0 {
+		return ss + strings.Repeat(" ", pad)
+	}
+	return ss
+}
+
+// Greedily break words into lines of at most width runes, returning the
+// line each word falls on. Words longer than the width get a line of
+// their own. A width of zero never wraps.
+func breakWords(words []string, width int) []int {
+	lineOf := make([]int, len(words))
+	line, length := 0, 0
+	for ii, ww := range words {
+		if length != 0 && width > 0 && length+1+runeLen(ww) > width {
+			line++
+			length = 0
+		}
+		if length != 0 {
+			length++
+		}
+		length += runeLen(ww)
+		lineOf[ii] = line
+	}
+	return lineOf
+}
+
+func wrapWords(words []string, width int) []string {
+	output := []string{}
+	for ii, ll := range breakWords(words, width) {
+		if ll == len(output) {
+			output = append(output, words[ii])
+		} else {
+			output[ll] += " " + words[ii]
+		}
+	}
+	return output
+}
+
+type layoutNote struct {
+	word  int
+	lines []string
+}
+
+// A placed note occupies main lines [start, end)
+type layoutSpan struct {
+	start int
+	end   int
+}
+
+type paragraphLayout struct {
+	words  []string
+	breaks map[int]bool
+	foots  []layoutNote
+	lefts  []layoutNote
+	rights []layoutNote
+	// Left sidenote markers and opening quotes lead the next word
+	prefix string
+}
+
+func (pl *paragraphLayout) addWords(ss string) {
+	for _, ww := range strings.Fields(ss) {
+		pl.words = append(pl.words, pl.prefix+ww)
+		pl.prefix = ""
+	}
+}
+
+// Footnote and right sidenote markers trail the word they annotate
+func (pl *paragraphLayout) markLastWord(marker string) int {
+	if len(pl.words) == 0 || pl.prefix != "" {
+		pl.words = append(pl.words, pl.prefix)
+		pl.prefix = ""
+	}
+	last := len(pl.words) - 1
+	pl.words[last] += marker
+	return last
+}
+
+// Emphasis joined to emphasis with the same delimiters would read as
+// one run of them
+func runsOn(word, next string) bool {
+	last, _ := utf8.DecodeLastRuneInString(word)
+	first, _ := utf8.DecodeRuneInString(next)
+	return isDelimiter(last) && last == first
+}
+
+func (jj Justification) addElement(pl *paragraphLayout, ee Element) error {
+	switch ee.(type) {
+	default:
+		return errors.New("Bad type in layout")
+	case *Text, *Emphasis:
+		last := len(pl.words) - 1
+		if joinsPrevious(ee) && last >= 0 && pl.prefix == "" && !pl.breaks[last] &&
+			!runsOn(pl.words[last], markedText(ee)) {
+			words := strings.Fields(markedText(ee))
+			pl.words[last] += words[0]
+			pl.addWords(strings.Join(words[1:], " "))
+		} else {
+			pl.addWords(markedText(ee))
+		}
+	case *InlineQuote:
+		iq := ee.(*InlineQuote)
+		pl.prefix += lquo
+		for _, inner := range iq.Elements {
+			if err := jj.addElement(pl, inner); err != nil {
+				return err
+			}
+		}
+		if iq.Citation != "" {
+			pl.addWords(citation + " " + iq.Citation)
+		}
+		pl.markLastWord(rquo)
+	case *LineBreak:
+		if len(pl.words) != 0 {
+			pl.breaks[len(pl.words)-1] = true
+		}
+	case *Footnote:
+		ww := pl.markLastWord(dagger)
+		lines := wrapWords(strings.Fields(dagger+ee.ToText()), jj.Width)
+		for ii := 1; ii < len(lines); ii++ {
+			lines[ii] = escapeHash(lines[ii])
+		}
+		pl.foots = append(pl.foots, layoutNote{ww, lines})
+	case *Rightnote:
+		ww := pl.markLastWord(ring)
+		lines := wrapWords(strings.Fields(ring+ee.ToText()), jj.NoteWidth)
+		pl.rights = append(pl.rights, layoutNote{ww, lines})
+	case *Leftnote:
+		lines := wrapWords(strings.Fields(dot+ee.ToText()), jj.NoteWidth)
+		pl.lefts = append(pl.lefts, layoutNote{len(pl.words), lines})
+		pl.prefix += dot
+	}
+	return nil
+}
+
+func (jj Justification) layoutParagraph(bb *Block, open, closing string) (*paragraphLayout, error) {
+	pl := &paragraphLayout{breaks: map[int]bool{}}
+
+	for _, ee := range bb.Elements {
+		if err := jj.addElement(pl, ee); err != nil {
+			return pl, err
+		}
+	}
+	if pl.prefix != "" {
+		pl.words = append(pl.words, pl.prefix)
+	}
+
+	if len(pl.words) != 0 {
+		pl.words[0] = open + pl.words[0]
+		pl.words[len(pl.words)-1] += closing
+	}
+	for ii := range pl.words {
+		// Text after a sidenote marker is read as a line of its own
+		if ii != 0 && strings.HasSuffix(pl.words[ii-1], ring) {
+			pl.words[ii] = escapeHash(pl.words[ii])
+		}
+		pl.words[ii] = strings.ReplaceAll(pl.words[ii], dot+"#", dot+"\\#")
+		pl.words[ii] = escapeLiterals(pl.words[ii])
+	}
+
+	return pl, nil
+}
+
+// Place notes in a channel, in order, starting beside the line holding
+// their marker or, if that is taken, the next free line
+func placeNotes(notes []layoutNote, lineOf []int, channel *([]string)) []layoutSpan {
+	spans := []layoutSpan{}
+	free := 0
+	for _, nn := range notes {
+		start := free
+		if nn.word < len(lineOf) && lineOf[nn.word] > start {
+			start = lineOf[nn.word]
+		}
+		for ii, ll := range nn.lines {
+			for start+ii >= len(*channel) {
+				*channel = append(*channel, "")
+			}
+			(*channel)[start+ii] = ll
+		}
+		free = start + len(nn.lines)
+		spans = append(spans, layoutSpan{start, free})
+	}
+	return spans
+}
+
+// A line of text starting with a hash would be read as a header
+func escapeHash(ll string) string {
+	if strings.HasPrefix(ll, "#") {
+		return "\\" + ll
+	}
+	return ll
+}
+
+func channelWidth(lines []string, minimum int) int {
+	width := minimum
+	for _, ll := range lines {
+		if runeLen(ll) > width {
+			width = runeLen(ll)
+		}
+	}
+	return width
+}
+
+func (jj Justification) paragraphLines(bb *Block, open, closing string) ([]string, error) {
+	pl, err := jj.layoutParagraph(bb, open, closing)
+	if err != nil {
+		return []string{}, err
+	}
+
+	// Fill the main column, remembering which line each word landed on
+	main := []string{}
+	lineBreak := []bool{}
+	lineOf := make([]int, len(pl.words))
+	start := 0
+	for ii := range pl.words {
+		if !pl.breaks[ii] && ii != len(pl.words)-1 {
+			continue
+		}
+		for kk, ll := range breakWords(pl.words[start:ii+1], jj.Width) {
+			lineOf[start+kk] = len(main) + ll
+		}
+		for kk, ll := range wrapWords(pl.words[start:ii+1], jj.Width) {
+			if len(main) != 0 || kk != 0 || open == "" {
+				ll = escapeHash(ll)
+			}
+			main = append(main, ll)
+		}
+		for len(lineBreak) < len(main) {
+			lineBreak = append(lineBreak, false)
+		}
+		lineBreak[len(lineBreak)-1] = pl.breaks[ii]
+		start = ii + 1
+	}
+
+	left := make([]string, len(main))
+	right := make([]string, len(main))
+	spans := placeNotes(pl.lefts, lineOf, &left)
+	spans = append(spans, placeNotes(pl.rights, lineOf, &right)...)
+	for len(left) < len(right) {
+		left = append(left, "")
+	}
+	for len(right) < len(left) {
+		right = append(right, "")
+	}
+	for len(main) < len(left) {
+		main = append(main, "")
+		lineBreak = append(lineBreak, false)
+	}
+
+	// A footnote follows the line holding its dagger, pushed down past
+	// any sidenote that would otherwise be split by it
+	blocks := map[int][]string{}
+	for _, ff := range pl.foots {
+		boundary := lineOf[ff.word] + 1
+		for moved := true; moved; {
+			moved = false
+			for _, ss := range spans {
+				if ss.start < boundary && boundary < ss.end {
+					boundary = ss.end
+					moved = true
+				}
+			}
+		}
+		blocks[boundary] = append(blocks[boundary], ff.lines...)
+		blocks[boundary] = append(blocks[boundary], "")
+	}
+
+	gutter := 0
+	if len(pl.lefts) != 0 {
+		gutter = channelWidth(left, jj.NoteWidth) + channelGap
+	}
+	column := gutter + channelWidth(main, jj.Width) + channelGap
+
+	output := []string{}
+	for ii := range main {
+		ss := padRight(left[ii], gutter) + main[ii]
+		if right[ii] != "" {
+			ss = padRight(ss, column) + right[ii]
+		}
+		ss = strings.TrimRight(ss, " ")
+		if lineBreak[ii] {
+			ss += "  "
+		}
+		output = append(output, ss)
+
+		if block, ok := blocks[ii+1]; ok {
+			output = append(output, "")
+			output = append(output, block...)
+		}
+	}
+
+	return output, nil
+}
+
+func (jj Justification) quoteLines(bq *BlockQuote) ([]string, error) {
+	inner := jj
+	if inner.Width > len(quoteIndent) {
+		inner.Width -= len(quoteIndent)
+	}
+
+	lines := []string{}
+	for ii := range bq.Paragraphs {
+		open, closing := "", ""
+		if ii == 0 {
+			open = lquo
+		}
+		if ii == len(bq.Paragraphs)-1 {
+			closing = rquo
+		}
+		if ii != 0 {
+			lines = append(lines, "")
+		}
+		para, err := inner.paragraphLines(&bq.Paragraphs[ii].Block, open, closing)
+		if err != nil {
+			return []string{}, err
+		}
+		lines = append(lines, para...)
+	}
+
+	if bq.Citation != "" {
+		lines = append(lines, "")
+		lines = append(lines, wrapWords(strings.Fields(bq.Citation), inner.Width)...)
+	}
+
+	output := []string{}
+	for _, ll := range lines {
+		if ll != "" {
+			ll = quoteIndent + ll
+		}
+		output = append(output, ll)
+	}
+	return output, nil
+}
+
+// A header keeps its text on one line, with its notes laid out as in a
+// paragraph
+func (jj Justification) headerLines(hh *Header) ([]string, error) {
+	hashes := strings.Repeat("#", hh.Level)
+	if len(hh.Elements) == 0 {
+		return []string{hashes + "  " + hashes}, nil
+	}
+	inner := jj
+	inner.Width = 0
+	return inner.paragraphLines(&hh.Block, hashes+" ", " "+hashes)
+}
+
+// Lines lays a document out as Marginalia text, one string per line,
+// with a blank line between collections
+func (jj Justification) Lines(coll []Collection) ([]string, error) {
+	output := []string{}
+	for ii, cc := range coll {
+		var lines []string
+		err := Check(cc)
+		if err != nil {
+			return output, err
+		}
+
+		switch cc.(type) {
+		default:
+			lines = cc.ToStrings()
+		case *Header:
+			lines, err = jj.headerLines(cc.(*Header))
+		case *Paragraph:
+			lines, err = jj.paragraphLines(&cc.(*Paragraph).Block, "", "")
+		case *BlockQuote:
+			lines, err = jj.quoteLines(cc.(*BlockQuote))
+		}
+		if err != nil {
+			return output, err
+		}
+
+		if ii != 0 {
+			output = append(output, "")
+		}
+		output = append(output, lines...)
+	}
+	return output, nil
+}
@@ -0,0 +1,102 @@
+package process
+
+import (
+	_ "embed"
+	"strconv"
+)
+
+// HtmlProfile sets how notes are laid out in html
+type HtmlProfile int
+
+const (
+	// Notes are spans beside their marks, for a stylesheet to place
+	PlainProfile HtmlProfile = iota
+	// Notes float into the left and right margins on wide screens, and
+	// open from their marks on narrow ones. MarginStylesheet is put in
+	// the document head, and the body has the class margins.
+	MarginProfile
+)
+
+// MarginStylesheet is the css for MarginProfile
+//
+//go:embed margins.css
+var MarginStylesheet string
+
+// A note whose mark opens and closes it on narrow screens
+type marginNote struct {
+	id    int
+	mark  string
+	class string
+	note  *Note
+}
+
+func (mn *marginNote) ToHtml() string {
+	id := "note-" + strconv.Itoa(mn.id)
+	output := "<label for=\"" + id + "\" class=\"margin-toggle\">" + mn.mark + "</label>"
+	output += "<input type=\"checkbox\" id=\"" + id + "\" class=\"margin-toggle\"/>"
+	output += "<span class=\"" + mn.class + "\">" + mn.note.ToHtml() + "</span>"
+	return output
+}
+
+func (mn *marginNote) ToText() string {
+	return mn.mark
+}
+
+// Replace the notes of a document with margin notes. The collections
+// given are not changed.
+func placeMarginNotes(coll []Collection, opts HtmlOptions) []Collection {
+	if opts.Profile != MarginProfile {
+		return coll
+	}
+
+	count := 0
+	var replace func(elements []Element) []Element
+	replace = func(elements []Element) []Element {
+		replaced := []Element{}
+		for _, ee := range elements {
+			switch ee.(type) {
+			default:
+				replaced = append(replaced, ee)
+			case *Footnote:
+				count++
+				replaced = append(replaced, &marginNote{count, dagger, "footnote", &ee.(*Footnote).Note})
+			case *Leftnote:
+				count++
+				replaced = append(replaced, &marginNote{count, dot, "leftnote", &ee.(*Leftnote).Note})
+			case *Rightnote:
+				count++
+				replaced = append(replaced, &marginNote{count, ring, "rightnote", &ee.(*Rightnote).Note})
+			case *InlineQuote:
+				iq := *ee.(*InlineQuote)
+				iq.Elements = replace(iq.Elements)
+				replaced = append(replaced, &iq)
+			}
+		}
+		return replaced
+	}
+
+	output := []Collection{}
+	for _, cc := range coll {
+		switch cc.(type) {
+		default:
+			output = append(output, cc)
+		case *Header:
+			hh := *cc.(*Header)
+			hh.Elements = replace(hh.Elements)
+			output = append(output, &hh)
+		case *Paragraph:
+			pp := *cc.(*Paragraph)
+			pp.Elements = replace(pp.Elements)
+			output = append(output, &pp)
+		case *BlockQuote:
+			bq := *cc.(*BlockQuote)
+			bq.Paragraphs = []Paragraph{}
+			for _, pp := range cc.(*BlockQuote).Paragraphs {
+				pp.Elements = replace(pp.Elements)
+				bq.Paragraphs = append(bq.Paragraphs, pp)
+			}
+			output = append(output, &bq)
+		}
+	}
+	return output
+}
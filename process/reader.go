@@ -0,0 +1,199 @@
+package process
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+)
+
+// Importer reads a document a piece at a time, so that memory grows with
+// the longest paragraph rather than with the document. A piece ends at
+// a blank line that nothing before it carries on past: not inside a
+// quotation, not before a footnote, not after a footnote that interrupts
+// a paragraph, and not while a dagger waits for its footnote.
+type Importer struct {
+	reader  *bufio.Reader
+	anchors anchorSet
+	// Collections read and not yet returned, and the errors found with
+	// them
+	pending []Collection
+	errs    ErrorList
+	// Lines and bytes before the next piece
+	line   int
+	offset int
+	// The first line of the next piece, read while looking for the end
+	// of the last one
+	ahead   string
+	atEnd   bool
+	readErr error
+}
+
+// ImportReader reads a document from rr as Import does, returning it a
+// collection at a time from Next
+func ImportReader(rr io.Reader) *Importer {
+	return &Importer{reader: bufio.NewReader(rr), anchors: anchorSet{}}
+}
+
+func isQuoteText(ss string) bool {
+	return strings.HasPrefix(ss, "    ")
+}
+
+// The text of the next piece, and false when there is none
+func (im *Importer) readPiece() (string, bool) {
+	piece := strings.Builder{}
+	daggers, notes := 0, 0
+	blanks := 0
+	lastQuote := false
+	// Whether the last block is a footnote, and whether its lines are
+	// still being read
+	noteBlock, inNote := false, false
+
+	canEnd := func(ll string) bool {
+		return blanks != 0 && daggers == notes && !strings.HasPrefix(ll, dagger) &&
+			!(lastQuote && isQuoteText(ll)) && !(noteBlock && blanks == 1)
+	}
+
+	for {
+		var ll string
+		if im.ahead != "" {
+			ll, im.ahead = im.ahead, ""
+		} else if im.atEnd {
+			break
+		} else {
+			var err error
+			ll, err = im.reader.ReadString('\n')
+			if err != nil {
+				im.atEnd = true
+				if err != io.EOF {
+					im.readErr = err
+				}
+				if ll == "" {
+					break
+				}
+			}
+		}
+
+		text := strings.TrimSuffix(strings.TrimSuffix(ll, "\n"), "\r")
+		if text != "" && piece.Len() != 0 && canEnd(text) {
+			im.ahead = ll
+			break
+		}
+		piece.WriteString(ll)
+
+		if text == "" {
+			blanks++
+			inNote = false
+			continue
+		}
+		switch {
+		case blanks != 0 && strings.HasPrefix(text, dagger):
+			notes++
+			noteBlock, inNote = true, true
+		case inNote:
+		default:
+			noteBlock = false
+			if !isQuoteText(text) {
+				daggers += strings.Count(text, dagger)
+			}
+		}
+		lastQuote = isQuoteText(text)
+		blanks = 0
+	}
+	return piece.String(), piece.Len() != 0
+}
+
+// Next returns the next collection of the document, or io.EOF when all
+// have been read. Problems found in a piece of the document come as an
+// ErrorList with its first collection, which may then be nil. Their
+// positions are in the whole document.
+func (im *Importer) Next() (Collection, error) {
+	for len(im.pending) == 0 && len(im.errs) == 0 {
+		piece, ok := im.readPiece()
+		if !ok {
+			if im.readErr != nil {
+				return nil, im.readErr
+			}
+			return nil, io.EOF
+		}
+
+		im.pending, im.errs = importText(piece, im.anchors)
+		for _, ee := range im.errs {
+			ee.shift(im.line, im.offset)
+		}
+		for _, sp := range documentSpans(im.pending) {
+			sp.Start.shift(im.line, im.offset)
+			sp.End.shift(im.line, im.offset)
+		}
+		im.line += strings.Count(piece, "\n")
+		im.offset += len(piece)
+	}
+
+	var cc Collection
+	if len(im.pending) != 0 {
+		cc, im.pending = im.pending[0], im.pending[1:]
+	}
+	err := im.errs.err()
+	im.errs = nil
+	return cc, err
+}
+
+// CheckReader reports the first line of a document read from rr that
+// Reformat at the given widths would change, as CheckCanonical does, but
+// a collection at a time
+func CheckReader(rr io.Reader, jj Justification) error {
+	// The source read and the canonical text made from it, each from
+	// the first line not yet matched
+	source := &bytes.Buffer{}
+	expected := ""
+	line, offset := 0, 0
+	im := ImportReader(io.TeeReader(rr, source))
+
+	mismatch := func() error {
+		errs := notCanonical(source.String(), expected)
+		errs[0].shift(line, offset)
+		return errs
+	}
+
+	count := 0
+	for {
+		cc, err := im.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		lines, err := jj.Lines([]Collection{cc})
+		if err != nil {
+			return err
+		}
+		if count != 0 {
+			expected += "\n"
+		}
+		expected += strings.Join(lines, "\n") + "\n"
+		count++
+
+		for {
+			nn := strings.IndexByte(expected, '\n')
+			mm := bytes.IndexByte(source.Bytes(), '\n')
+			if nn == -1 || mm == -1 {
+				break
+			}
+			if expected[:nn+1] != string(source.Bytes()[:mm+1]) {
+				return mismatch()
+			}
+			expected = expected[nn+1:]
+			source.Next(mm + 1)
+			line++
+			offset += mm + 1
+		}
+	}
+	if count == 0 {
+		expected = "\n"
+	}
+	if source.Len() != 0 || expected != "" {
+		return mismatch()
+	}
+	return nil
+}
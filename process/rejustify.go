@@ -1,162 +1,217 @@
 package process
 
 import (
-	"errors"
 	"fmt"
 	"regexp"
 	"strings"
+	"unicode/utf8"
 )
 
 // Problems list
 
-// Sidenotes
-// Not implemented
+type intermediates interface {
+}
 
-// BlockQuotes
-// Not implemented. Current mock needs to be updated for footnotes
+// The text of a line. Plain strings are accepted from callers that have
+// no source positions.
+func asSource(ll intermediates) (sourceText, bool) {
+	switch ll.(type) {
+	case sourceText:
+		return ll.(sourceText), true
+	case string:
+		return madeUp(ll.(string)), true
+	}
+	return sourceText{}, false
+}
 
-// Rejustify
-// Not implemented
+// A problem with a line, or with a node read from lines, at where it
+// starts
+func lineError(code ErrorCode, message string, ll intermediates) *ParseError {
+	st, _ := asSource(ll)
+	pe := newParseError(code, message, st)
+	if sn, ok := ll.(spanned); ok {
+		pe.Offset = sn.source().Start.Offset
+	}
+	return pe
+}
 
-type intermediates interface {
+func isBlank(ll intermediates) bool {
+	st, ok := asSource(ll)
+	return ok && st.text == ""
 }
 
-func consumeHeaders(input *([]intermediates)) ([]intermediates, error) {
-	var output []intermediates
-	re := regexp.MustCompile("^(#+)(.*?)(#+)$")
-	for _, ll := range *input {
-		switch ll.(type) {
-		default:
-			output = append(output, ll)
-		case string:
-			if res := re.FindStringSubmatch(ll.(string)); res != nil {
-				if res[1] != res[3] {
-					fmt.Println(res[1])
-					fmt.Println(res[3])
-					return *input, errors.New("Header levels not matched")
-				}
-				head := Header{}
-				head.Level = len(res[1])
-				head.AddElement(&Text{strings.Trim(res[2], " ")})
-				output = append(output, &head)
-			} else {
-				output = append(output, ll)
-			}
+// Give plain strings back to a caller that passed plain strings in
+func plainOutput(input, output []intermediates) []intermediates {
+	plain := false
+	for _, ll := range input {
+		if _, ok := ll.(string); ok {
+			plain = true
+		}
+	}
+	if !plain {
+		return output
+	}
+	lines := []intermediates{}
+	for _, ll := range output {
+		if st, ok := ll.(sourceText); ok {
+			lines = append(lines, st.text)
+		} else {
+			lines = append(lines, ll)
 		}
 	}
-	return output, nil
+	return lines
 }
 
-func consumeQuotes(input *([]intermediates)) ([]intermediates, error) {
-	var output []intermediates
-	var err error
-	var quote *BlockQuote
+var (
+	openingHashes       = regexp.MustCompile("^#+")
+	spacedClosingHashes = regexp.MustCompile("(^| )(#+)$")
+	closingHashes       = regexp.MustCompile("#+$")
+	quoteLine           = regexp.MustCompile("^ {4}(.*)$")
+	channelGapPattern   = regexp.MustCompile(" {2,}")
+	rightnoteStart      = regexp.MustCompile("^(.*?) {2,}" + ring)
+	rightnoteGap        = regexp.MustCompile("(^| {2,})" + ring)
+)
+
+// A header whose inline content is read along with the paragraphs
+type headerLine struct {
+	level   int
+	content []intermediates
+	span    Span
+}
+
+// Read the hashes around the pieces of a header line. Pieces that are
+// not a header give a nil headerLine.
+func makeHeaderLine(pieces []intermediates) (*headerLine, error) {
+	first, ok := asSource(pieces[0])
+	last, ok2 := asSource(pieces[len(pieces)-1])
+	if !ok || !ok2 {
+		return nil, nil
+	}
+	span := sourceSpan(first, last)
 
-	quoteLines := []string{}
+	// Closing hashes are optional, but must follow a space unless the
+	// opening hashes have none after them
+	opening := openingHashes.FindString(first.text)
+	if opening == "" {
+		return nil, nil
+	}
+	content := append([]intermediates{}, pieces...)
+	content[0] = first.slice(len(opening), len(first.text))
+	last, _ = asSource(content[len(content)-1])
+
+	spaced := strings.HasPrefix(content[0].(sourceText).text, " ") || content[0].(sourceText).text == ""
+	closing := ""
+	if spaced {
+		if res := spacedClosingHashes.FindStringSubmatch(last.text); res != nil {
+			closing = res[2]
+		}
+	} else {
+		closing = closingHashes.FindString(last.text)
+		if closing == "" {
+			return nil, nil
+		}
+	}
+	if closing == "" && strings.Trim(last.text, " ") == "" && len(content) == 1 {
+		return nil, nil
+	}
+	if closing != "" && opening != closing {
+		return nil, newParseError(ErrHeaderLevels, "Header levels not matched", first)
+	}
+	content[len(content)-1] = last.slice(0, len(last.text)-len(closing))
 
+	hl := &headerLine{level: len(opening), span: span}
+	for _, ll := range content {
+		if st, ok := asSource(ll); ok {
+			if st = st.trim(" "); st.text == "" {
+				continue
+			}
+			ll = st
+		}
+		hl.content = append(hl.content, ll)
+	}
+	return hl, nil
+}
+
+func makeHeader(hl *headerLine) (*Header, error) {
+	head := &Header{Level: hl.level}
+	head.Span = hl.span
+	elements, err := makeText(hl.content)
+	for _, ee := range elements {
+		head.AddElement(ee)
+	}
+	head.coverElements()
+	return head, err
+}
+
+func consumeHeaders(input *([]intermediates)) ([]intermediates, error) {
+	var output []intermediates
+	errs := ErrorList{}
 	for _, ll := range *input {
 		switch ll.(type) {
 		default:
 			output = append(output, ll)
-			if len(quoteLines) != 0 {
-				quote, err = makeQuote(quoteLines)
-				output = append(output, quote)
-			}
-			quoteLines = []string{}
-		case string:
-			re := regexp.MustCompile("^ {4}(.*)$")
-			if res := re.FindStringSubmatch(ll.(string)); res != nil {
-				quoteLines = append(quoteLines, ll.(string)[4:])
+		case sourceText, string:
+			hl, err := makeHeaderLine([]intermediates{ll})
+			errs.add(err)
+			if hl != nil {
+				output = append(output, hl)
 			} else {
 				output = append(output, ll)
-				if len(quoteLines) != 0 {
-					quote, err = makeQuote(quoteLines)
-					output = append(output, quote)
-					quoteLines = []string{}
-				}
 			}
 		}
 	}
-
-	return output, err
+	return output, errs.err()
 }
 
-// Return paragraph elements
-func makeText(input []intermediates) ([]Element, error) {
-	// Emphasis is preserved across notes, linebreaks;
-	// it is an error when it hits a quote
-	// Linebreaks are ignored unless they follow two spaces
+func consumeQuotes(input *([]intermediates)) ([]intermediates, error) {
+	var output []intermediates
+	errs := ErrorList{}
 
-	output := []Element{}
-	var err error
+	quoteLines := []sourceText{}
+	re := quoteLine
 
-	text := new(string)
-	strong := false
-	em := false
+	isQuoteLine := func(ll intermediates) bool {
+		st, ok := asSource(ll)
+		return ok && re.MatchString(st.text)
+	}
 
-	AddTextEm := func(coll *([]Element), text *string, strong bool, em bool) *string {
-		ss := strings.Trim(*text, " \n")
-		if len(ss) != 0 {
-			if strong || em {
-				*coll = append(*coll, &Emphasis{Text{ss}, em, strong})
-			} else {
-				*coll = append(*coll, &Text{ss})
+	// Blank lines stay in a quotation that carries on after them
+	continuesQuote := func(ii int) bool {
+		for ; ii < len(*input); ii++ {
+			if !isBlank((*input)[ii]) {
+				return isQuoteLine((*input)[ii])
 			}
 		}
-		return new(string)
+		return false
 	}
 
-	for _, ll := range input {
-		if *text != "" {
-			if (*text)[len(*text)-1] != ' ' {
-				*text += " "
+	addQuote := func() {
+		if len(quoteLines) != 0 {
+			quote, err := makeQuote(quoteLines)
+			errs.add(err)
+			if len(quote.Paragraphs) != 0 || quote.Citation != "" {
+				output = append(output, quote)
 			}
+			quoteLines = []sourceText{}
 		}
-		switch ll.(type) {
-		default:
-			err = errors.New("makeText: Unexpected type")
-			return output, err
-		case *Footnote:
-			text = AddTextEm(&output, text, strong, em)
-			output = append(output, ll.(*Footnote))
-		case *Leftnote:
-			output = append(output, ll.(*Leftnote))
-		case *Rightnote:
-			output = append(output, ll.(*Rightnote))
-		case *InlineQuote:
-			output = append(output, ll.(*InlineQuote))
-		case string:
-			newline := false
-			ss := ll.(string)
-			re := regexp.MustCompile("^.* {2}$")
-			if re.MatchString(ss) {
-				ss = ss[:len(ss)-2]
-				newline = true
-			}
-			for _, letter := range ss {
-				switch letter {
-				case '*', '_':
-					if len(ss) != 0 {
-						text = AddTextEm(&output, text, strong, em)
-					}
-					if letter == '*' {
-						strong = !strong
-					} else {
-						em = !em
-					}
-				default:
-					*text += string(letter)
-				}
-			}
-			if newline {
-				text = AddTextEm(&output, text, strong, em)
-				output = append(output, &LineBreak{})
-			}
+	}
+
+	for ii, ll := range *input {
+		if isQuoteLine(ll) {
+			st, _ := asSource(ll)
+			quoteLines = append(quoteLines, st.slice(4, len(st.text)))
+			continue
+		}
+		if isBlank(ll) && len(quoteLines) != 0 && continuesQuote(ii) {
+			quoteLines = append(quoteLines, sourceText{})
+			continue
 		}
+		addQuote()
+		output = append(output, ll)
 	}
+	addQuote()
 
-	text = AddTextEm(&output, text, strong, em)
-	return output, err
+	return output, errs.err()
 }
 
 type consumeFootnoteState struct {
@@ -165,7 +220,7 @@ type consumeFootnoteState struct {
 	footNoteCompleted  bool
 	startLine          int
 	endLine            int
-	foot               []string
+	foot               []sourceText
 }
 
 func (cfs *consumeFootnoteState) startFootnote(ii int) {
@@ -187,29 +242,25 @@ func (cfs *consumeFootnoteState) nonString(ii int) {
 	}
 }
 
-func (cfs *consumeFootnoteState) stringEncountered(ii int, ss string) {
+func (cfs *consumeFootnoteState) stringEncountered(ii int, ss sourceText) {
 	if !cfs.footNoteInProgress && !cfs.footNoteCompleted {
-		if ss == "" {
-			cfs.lastBlank = true
-		}
-		if cfs.lastBlank && len(ss) >= len(dagger) {
-			if ss[:len(dagger)] == dagger {
-				cfs.startFootnote(ii)
-				cfs.foot = append(cfs.foot, ss[len(dagger):])
-			}
+		if cfs.lastBlank && strings.HasPrefix(ss.text, dagger) {
+			cfs.startFootnote(ii)
+			cfs.foot = append(cfs.foot, ss.slice(len(dagger), len(ss.text)))
 		}
+		cfs.lastBlank = ss.text == ""
 		return
 	}
 
 	if cfs.footNoteInProgress {
-		if ss == "" {
+		if ss.text == "" {
 			cfs.endFootnote(ii + 1)
 		}
 		cfs.foot = append(cfs.foot, ss)
 	}
 }
 
-func makeFootnote(input []string) (*Footnote, error) {
+func makeFootnote(input []sourceText) (*Footnote, error) {
 	//when presented with strings,
 	//makeText consumes them as Text, Emphasis
 	inter := []intermediates{}
@@ -224,100 +275,145 @@ func makeFootnote(input []string) (*Footnote, error) {
 
 func consumeFootnotes(input *([]intermediates)) ([]intermediates, error) {
 
-	var err error
-	findFootnote := func(input *([]intermediates)) consumeFootnoteState {
+	errs := ErrorList{}
 
-		state := consumeFootnoteState{}
+	splitAtDagger := func(st sourceText, foot *Footnote) ([]intermediates, bool) {
+		idx := strings.Index(st.text, dagger)
+		if strings.HasPrefix(st.text, "    ") {
+			//Daggers in quotations belong to their own footnotes
+			idx = -1
+		}
+		if idx == -1 {
+			return []intermediates{st}, false
+		}
+		output := []intermediates{}
+		if ss1 := st.slice(0, idx).trim(" "); ss1.text != "" {
+			output = append(output, ss1)
+		}
+		output = append(output, foot)
+		ss2 := st.slice(idx+len(dagger), len(st.text))
+		if strings.Trim(ss2.text, " ") != "" {
+			output = append(output, ss2.trimLeft(" "))
+		} else if hasLineBreak(ss2.text) {
+			output = append(output, ss2.slice(len(ss2.text)-2, len(ss2.text)))
+		}
+		return output, true
+	}
 
-		for ii, ll := range *input {
-			switch ll.(type) {
-			default:
-				state.nonString(ii)
-			case string:
-				state.stringEncountered(ii, ll.(string))
+	// Lift every footnote out in one pass
+	state := consumeFootnoteState{}
+	drop := make([]bool, len(*input))
+	foots := []*Footnote{}
+	starts := []sourceText{}
+
+	liftFootnote := func() {
+		// Footnotes that follow one another share the blank line
+		// between them
+		shared := false
+		if state.endLine < len(*input) {
+			if st, ok := asSource((*input)[state.endLine]); ok && strings.HasPrefix(st.text, dagger) {
+				state.endLine--
+				shared = true
 			}
 		}
+		for ii := state.startLine; ii < state.endLine; ii++ {
+			drop[ii] = true
+		}
+		foot, err := makeFootnote(state.foot)
+		errs.add(err)
+		line, _ := asSource((*input)[state.startLine+1])
+		foot.Span = sourceSpan(append([]sourceText{line}, state.foot...)...)
+		foots = append(foots, foot)
+		starts = append(starts, state.foot[0])
+		state = consumeFootnoteState{lastBlank: shared}
+	}
 
-		state.nonString(len(*input))
-		return state
+	for ii, ll := range *input {
+		if st, ok := asSource(ll); ok {
+			state.stringEncountered(ii, st)
+		} else {
+			state.nonString(ii)
+		}
+		if state.footNoteCompleted {
+			liftFootnote()
+		}
+	}
+	state.nonString(len(*input))
+	if state.footNoteCompleted {
+		liftFootnote()
 	}
 
-	putAtDagger := func(input *([]intermediates), foot *Footnote) ([]intermediates, error) {
-		output := []intermediates{}
-		var addedFootnote bool = false
-		for _, ll := range *input {
-			if addedFootnote {
-				output = append(output, ll)
-				continue
+	// Then put them at the daggers left, the first footnote at the
+	// first dagger
+	next := 0
+	putAtDaggers := func(st sourceText) ([]intermediates, bool) {
+		pieces := []intermediates{}
+		added := false
+		for next < len(foots) {
+			parts, ok := splitAtDagger(st, foots[next])
+			if !ok {
+				break
 			}
-			switch ll.(type) {
-			default:
-				output = append(output, ll)
-			case string:
-				ss := ll.(string)
-				idx := strings.Index(ss, dagger)
-				if idx == -1 {
-					output = append(output, ll)
-				} else {
-					ss1 := strings.Trim(ss[0:idx], " ")
-					output = append(output, ss1)
-					output = append(output, foot)
-					if idx+len(dagger) < len(ss) {
-						ss2 := strings.Trim(ss[idx+len(dagger):], " ")
-						output = append(output, ss2)
-					}
-					addedFootnote = true
-				}
+			next++
+			added = true
+			rest, ok := parts[len(parts)-1].(sourceText)
+			if !ok {
+				return append(pieces, parts...), added
 			}
+			pieces = append(pieces, parts[:len(parts)-1]...)
+			st = rest
 		}
-		if addedFootnote {
-			return output, nil
-		} else {
-			return output, errors.New("No footnote added")
-		}
+		return append(pieces, st), added
 	}
 
-	replaceFootnote := func(input *([]intermediates)) ([]intermediates, bool, error) {
-		var err error
-		state := findFootnote(input)
-		output := []intermediates{}
-		if state.footNoteCompleted {
-			for ii, ll := range *input {
-				if ii < state.startLine || ii >= state.endLine {
-					output = append(output, ll)
+	output := []intermediates{}
+	for ii, ll := range *input {
+		if drop[ii] {
+			continue
+		}
+		if hl, ok := ll.(*headerLine); ok {
+			content := []intermediates{}
+			for _, cc := range hl.content {
+				st, ok := asSource(cc)
+				if !ok {
+					content = append(content, cc)
+					continue
 				}
+				pieces, added := putAtDaggers(st)
+				if !added {
+					pieces = []intermediates{cc}
+				}
+				content = append(content, pieces...)
 			}
-			var foot *Footnote
-			foot, err = makeFootnote(state.foot)
-			if err != nil {
-				return output, state.footNoteCompleted, err
-			}
-			output, err = putAtDagger(&output, foot)
-			return output, state.footNoteCompleted, err
-		} else {
-			return *input, state.footNoteCompleted, err
+			hl.content = content
+			output = append(output, hl)
+			continue
+		}
+		st, ok := asSource(ll)
+		if !ok {
+			output = append(output, ll)
+			continue
 		}
+		pieces, added := putAtDaggers(st)
+		if !added {
+			pieces = []intermediates{ll}
+		}
+		output = append(output, pieces...)
 	}
 
-	inters := []intermediates{}
-	var completed bool
-	for inters, completed, err = replaceFootnote(input); completed; {
-		if err != nil {
-			return inters, err
-		}
-		inters, completed, err = replaceFootnote(&inters)
+	for ; next < len(foots); next++ {
+		errs.add(newParseError(ErrUnplacedFootnote, "No footnote added", starts[next]))
 	}
 
-	return inters, err
+	return output, errs.err()
 }
 
 func printIntermediates(input []intermediates) {
 	for ii, ll := range input {
-		switch ll.(type) {
-		default:
+		if st, ok := asSource(ll); ok {
+			fmt.Printf("%d: %v\n", ii, st.text)
+		} else {
 			fmt.Printf("%d: %v\n", ii, ll.(Element).ToText())
-		case string:
-			fmt.Printf("%d: %v\n", ii, ll.(string))
 		}
 	}
 }
@@ -337,130 +433,503 @@ func makeParagraph(input []intermediates) (*Paragraph, error) {
 	for _, ee := range elements {
 		para.AddElement(ee)
 	}
+	para.Span = unknownSpan()
+	para.coverElements()
 
 	return para, err
 }
 
-func makeQuote(input []string) (*BlockQuote, error) {
-	return &BlockQuote{}, nil
+// A block holding only line breaks, as lines of spaces give, is left
+// out of the document, as is a quotation of nothing but such blocks
+func blankBlock(pp *Block) bool {
+	for _, ee := range pp.Elements {
+		switch ee.(type) {
+		case nil, *LineBreak:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// The text inside a Text or Emphasis element
+func textOf(ee Element) *Text {
+	switch ee.(type) {
+	case *Text:
+		return ee.(*Text)
+	case *Emphasis:
+		return &ee.(*Emphasis).Text
+	}
+	return nil
 }
 
-func consumeParagraphs(input *([]intermediates)) ([]intermediates, error) {
-	var output []intermediates
+// Strip the curly quotes around a quotation. Whatever follows the
+// paragraph they close is the citation.
+func splitCitation(input []intermediates) ([]intermediates, string) {
+	first := -1
+	for ii, ll := range input {
+		if !isBlank(ll) {
+			if st, ok := asSource(ll); ok && strings.HasPrefix(strings.TrimLeft(st.text, " "), lquo) {
+				first = ii
+			}
+			break
+		}
+	}
+	if first == -1 {
+		return input, ""
+	}
+
+	closing := -1
+	for ii := len(input) - 1; ii >= first; ii-- {
+		if st, ok := asSource(input[ii]); ok && strings.HasSuffix(strings.TrimRight(st.text, " "), rquo) {
+			closing = ii
+			break
+		}
+	}
+	if closing == -1 {
+		return input, ""
+	}
+
+	st, _ := asSource(input[first])
+	idx := strings.Index(st.text, lquo)
+	input[first] = st.slice(0, idx).add(st.slice(idx+len(lquo), len(st.text)))
+	st, _ = asSource(input[closing])
+	trimmed := st.trimRight(" ")
+	idx = len(trimmed.text) - len(rquo)
+	input[closing] = trimmed.slice(0, idx).add(st.slice(len(trimmed.text), len(st.text)))
+
+	end := closing + 1
+	for end < len(input) && !isBlank(input[end]) {
+		end++
+	}
+
+	cite := []string{}
+	for _, ll := range input[end:] {
+		if st, ok := asSource(ll); ok && strings.Trim(st.text, " ") != "" {
+			cite = append(cite, strings.Trim(st.text, " "))
+		}
+	}
+
+	//A mark alone would leave a blank line, which ends a paragraph
+	output := []intermediates{}
+	for ii, ll := range input[:end] {
+		if !isBlank(ll) || (ii != first && ii != closing) {
+			output = append(output, ll)
+		}
+	}
+	return output, strings.Join(cite, " ")
+}
+
+func makeQuote(input []sourceText) (*BlockQuote, error) {
+	//A quotation is read like a small document, without headers.
+	//When it opens with a curly quote, whatever follows the closing
+	//curly quote is the citation.
 	var err error
-	var para *Paragraph
+	errs := ErrorList{}
+	inter := []intermediates{}
+	for _, ss := range input {
+		inter = append(inter, ss)
+	}
+
+	passes := []func(*([]intermediates)) ([]intermediates, error){
+		linearizeRightnotes,
+		linearizeLeftnotes,
+		consumeSidenotes,
+		consumeFootnotes,
+	}
+	for _, pass := range passes {
+		inter, err = pass(&inter)
+		errs.add(err)
+	}
+
+	quote := &BlockQuote{Span: sourceSpan(input...)}
+	inter, quote.Citation = splitCitation(inter)
+
+	inter, err = consumeParagraphs(&inter, anchorSet{})
+	errs.add(err)
+
+	for _, ll := range inter {
+		switch ll.(type) {
+		default:
+			errs.add(lineError(ErrUnconsumedLines, "Non-consumed lines in quote", ll))
+		case *Paragraph:
+			quote.AddParagraph(*ll.(*Paragraph))
+			quote.cover(ll.(*Paragraph).Span)
+		}
+	}
+
+	return quote, errs.err()
+}
+
+func consumeParagraphs(input *([]intermediates), anchors anchorSet) ([]intermediates, error) {
+	var output []intermediates
+	errs := ErrorList{}
 
 	paraLines := []intermediates{}
+	addParagraph := func() {
+		if len(paraLines) != 0 {
+			para, err := makeParagraph(paraLines)
+			errs.add(err)
+			if !blankBlock(&para.Block) {
+				output = append(output, para)
+			}
+			paraLines = []intermediates{}
+		}
+	}
 
 	for _, ll := range *input {
 		switch ll.(type) {
 		default:
+			addParagraph()
 			output = append(output, ll)
-			if len(paraLines) != 0 {
-				para, err = makeParagraph(paraLines)
-				output = append(output, para)
-				paraLines = []intermediates{}
-			}
-		case *Footnote:
+		case *Footnote, *Leftnote, *Rightnote:
 			paraLines = append(paraLines, ll)
-		case string:
-			re := regexp.MustCompile("^$")
-			if res := re.FindStringSubmatch(ll.(string)); res != nil {
-				if len(paraLines) != 0 {
-					para, err = makeParagraph(paraLines)
-					output = append(output, para)
-					paraLines = []intermediates{}
-				}
+		case *headerLine:
+			addParagraph()
+			head, err := makeHeader(ll.(*headerLine))
+			errs.add(err)
+			anchors.assign(head)
+			output = append(output, head)
+		case sourceText, string:
+			if isBlank(ll) {
+				addParagraph()
 			} else {
 				paraLines = append(paraLines, ll)
 			}
 		}
 	}
+	addParagraph()
 
-	if len(paraLines) != 0 {
-		para, err = makeParagraph(paraLines)
-		output = append(output, para)
-	}
-
-	return output, err
+	return output, errs.err()
 }
 
 func convertToCollection(input *([]intermediates)) ([]Collection, error) {
 	coll := []Collection{}
-	var err error
+	errs := ErrorList{}
 	for _, ll := range *input {
 		switch ll.(type) {
 		default:
 			coll = append(coll, ll.(Collection))
-		case string:
-			err = errors.New("Non-consumed lines")
+		case sourceText, string:
+			st, _ := asSource(ll)
+			errs.add(newParseError(ErrUnconsumedLines, "Non-consumed lines", st))
+		}
+
+	}
+	return coll, errs.err()
+}
+
+// Group the indices of lines into paragraphs. Blank lines separate
+// paragraphs, except around a footnote, which interrupts a paragraph
+// without ending it unless a block quotation follows the footnote.
+// Footnote lines belong to no paragraph.
+func noteParagraphs(input []intermediates) [][]int {
+	isFootnote := func(ii int) bool {
+		st, ok := asSource(input[ii])
+		return ok && strings.HasPrefix(st.text, dagger)
+	}
+	// Text carrying on past a footnote beside left sidenotes is indented
+	// by their channel, which is always wider than a quotation's indent
+	isQuoteStart := func(ii int) bool {
+		st, ok := asSource(input[ii])
+		return ok && strings.HasPrefix(st.text, "    ") && len(st.text) > 4 && st.text[4] != ' '
+	}
+
+	paras := [][]int{}
+	para := []int{}
+	for ii := 0; ii < len(input); ii++ {
+		if !isBlank(input[ii]) {
+			para = append(para, ii)
+			continue
+		}
+		if ii+1 < len(input) && isFootnote(ii+1) {
+			for ii+1 < len(input) && !isBlank(input[ii+1]) {
+				ii++
+			}
+			if ii+2 < len(input) && isFootnote(ii+2) {
+				continue
+			}
+			ii++
+			if ii+1 < len(input) && isQuoteStart(ii+1) && len(para) != 0 {
+				paras = append(paras, para)
+				para = []int{}
+			}
+			continue
+		}
+		if len(para) != 0 {
+			paras = append(paras, para)
+			para = []int{}
+		}
+	}
+	if len(para) != 0 {
+		paras = append(paras, para)
+	}
+	return paras
+}
+
+// Paragraphs indented as block quotations are left for makeQuote
+func isQuoteParagraph(input []intermediates, para []int) bool {
+	st, ok := asSource(input[para[0]])
+	return ok && strings.HasPrefix(st.text, "    ")
+}
+
+func hasLeftnotes(input []intermediates, para []int) bool {
+	for _, ii := range para {
+		if st, ok := asSource(input[ii]); ok && strings.HasPrefix(st.text, dot) {
+			return true
 		}
+	}
+	return false
+}
+
+// The first line of a paragraph with a sidenote or marker on it
+func firstNoteLine(input []intermediates, para []int) sourceText {
+	first, _ := asSource(input[para[0]])
+	for _, ii := range para {
+		if st, ok := asSource(input[ii]); ok && strings.ContainsAny(st.text, dot+ring) {
+			return st
+		}
+	}
+	return first
+}
+
+func hasLineBreak(ss string) bool {
+	return strings.HasSuffix(ss, "  ")
+}
 
+// Split a line at its first gap of two or more spaces
+func splitAtGap(st sourceText) (sourceText, sourceText) {
+	re := channelGapPattern
+	loc := re.FindStringIndex(st.text)
+	if loc == nil {
+		return st, sourceText{}
 	}
-	return coll, err
+	return st.slice(0, loc[0]), st.slice(loc[1], len(st.text))
 }
 
 func linearizeLeftnotes(input *([]intermediates)) ([]intermediates, error) {
 	//Left notes start at the first character of one line and continue
-	//on succeeding lines (starting at the first character)
+	//on succeeding lines (starting at the first character, or lined up
+	//with the text of the note)
 	//there will be a blank spaces at the first normal string
 
-        output := []intermediates{}
-	for ii, ll := range *input {
-		switch ll.(type) {
-		default:
-			return []intermediates{}, errors.New("linearizeLeftnotes: non-string input")
-		case string:
-                        ss := ll.(string)
-                        re := regexp.MustCompile("^" + dot + ".*$")
-                        if re.MatchString(ss) {
-                                sideNote := ""
-                                re2 := regexp.MustCompile("^(" + dot + ".*) {2}.*$") 
-                                match := re2.FindStringSubmatch(ss)
-                                if match != nil {
-                                        replace := regexp.MustCompile("^" + dot + ".* {2}(.*$)")
-                                        sideNote = strings.Trim(match[1], " ")
-                                        if ii != 0 {
-                                                //Fix for blockquote
-                                                output[ii-1] = strings.TrimLeft(output[ii-1].(string), " ")
-                                        }
-                                        for jj := ii + 1; jj < len(*input) ; jj++ {
-                                                //Fix for blockquote
-                                                ss := (*input)[jj].(string)
-                                                if len(ss) == 0 || ss[0:1] == " " {
-                                                        (*input)[jj] = strings.TrimLeft(ss, " ")
-                                                        break
-                                                } else {
-                                                        rInner := regexp.MustCompile("^(.*) {2}(.*$)")
-                                                        mInner := rInner.FindStringSubmatch(ss)
-                                                        if mInner == nil {
-                                                                sideNote += " " + strings.Trim(ss, " ")
-                                                                (*input)[jj] = ""
-                                                        } else {
-                                                                sideNote += " " + strings.Trim(mInner[1], " ")
-                                                                //Fix for blockquote
-                                                                (*input)[jj] = strings.Trim(mInner[2], " ")
-                                                        }
-                                                }
-                                                fmt.Printf("SIDENOTE: %v\n", sideNote)
-                                        }
-                                        ss = replace.ReplaceAllString(ss, "$1")
-                                        ss = strings.TrimLeft(ss, " ")
-                                        sideNote = strings.Trim(sideNote, " ")
-                                        ss = sideNote + "  " + ss
-                                        output = append(output, ss)
-                                }
-                        } else {
-                                output = append(output, ss)
-                        }
-		}
-	}
-
-	return output, nil
+	//Each note is gathered onto the line it starts on, ahead of that
+	//line's text: "˙note text  main text". The rest of the paragraph
+	//loses the indentation of the note channel.
+	lines := []sourceText{}
+	for _, ll := range *input {
+		st, ok := asSource(ll)
+		if !ok {
+			return []intermediates{}, lineError(ErrUnexpectedType, "linearizeLeftnotes: non-string input", ll)
+		}
+		lines = append(lines, st)
+	}
+
+	drop := map[int]bool{}
+	for _, para := range noteParagraphs(*input) {
+		if !hasLeftnotes(*input, para) {
+			continue
+		}
+
+		noteLine := -1
+		note := sourceText{}
+		// Lines of a note after the first start at its text or at the
+		// margin
+		noteColumn := 0
+		endNote := func() {
+			if noteLine != -1 {
+				if lines[noteLine].text == "" {
+					lines[noteLine] = note
+				} else {
+					lines[noteLine] = note.addString("  ").add(lines[noteLine])
+				}
+			}
+			noteLine = -1
+		}
+
+		for jj, ii := range para {
+			ss := lines[ii]
+			if jj != 0 && para[jj-1] != ii-1 {
+				//Notes do not continue past a footnote
+				endNote()
+			}
+			switch {
+			case strings.HasPrefix(ss.text, dot):
+				endNote()
+				noteLine = ii
+				note, lines[ii] = splitAtGap(ss)
+				noteColumn = runeLen(dot) + indentOf(note.text[len(dot):])
+				note = note.trim(" ")
+			case noteLine != -1 && (indentOf(ss.text) == 0 || indentOf(ss.text) == noteColumn):
+				var part sourceText
+				part, lines[ii] = splitAtGap(ss)
+				note = note.addString(" ").add(part.trim(" "))
+				if lines[ii].text == "" {
+					drop[ii] = true
+				}
+			default:
+				if ss.text[0:1] == " " {
+					endNote()
+				}
+				lines[ii] = ss.trimLeft(" ")
+				if strings.HasPrefix(lines[ii].text, dot) {
+					//Keep a marker that starts the text from
+					//reading as a new note
+					lines[ii] = madeUp(" ").add(lines[ii])
+				}
+			}
+		}
+		endNote()
+	}
+
+	output := []intermediates{}
+	for ii, st := range lines {
+		if !drop[ii] {
+			output = append(output, st)
+		}
+	}
+	return plainOutput(*input, output), nil
+}
+
+// The spaces a line starts with
+func indentOf(ss string) int {
+	return len(ss) - len(strings.TrimLeft(ss, " "))
+}
+
+// Byte index in a line of the rune at col
+func byteIndex(ss string, col int) int {
+	idx := 0
+	for ii := 0; ii < col && idx < len(ss); ii++ {
+		_, size := utf8.DecodeRuneInString(ss[idx:])
+		idx += size
+	}
+	return idx
 }
 
 func linearizeRightnotes(input *([]intermediates)) ([]intermediates, error) {
-	return *input, nil
+	//Right notes start with a ring after a gap of at least two spaces
+	//and continue in the same column on succeeding lines. Each note is
+	//gathered onto the line it starts on: "main text  ˚note text"
+	lines := []sourceText{}
+	for _, ll := range *input {
+		st, ok := asSource(ll)
+		if !ok {
+			return []intermediates{}, lineError(ErrUnexpectedType, "linearizeRightnotes: non-string input", ll)
+		}
+		lines = append(lines, st)
+	}
+
+	ringRune := []rune(ring)[0]
+	re := rightnoteStart
+
+	// The column a note continues in, if line ii has text there
+	continues := func(ii, col int) bool {
+		ll := []rune(lines[ii].text)
+		return len(ll) > col && ll[col] != ' ' && ll[col] != ringRune &&
+			ll[col-1] == ' ' && ll[col-2] == ' '
+	}
+
+	// Text left of the note column, keeping any line break
+	mainText := func(st sourceText, col int) sourceText {
+		main := st.slice(0, byteIndex(st.text, col)).trimRight(" ")
+		if hasLineBreak(st.text) && main.text != "" {
+			main = main.addString("  ")
+		}
+		return main
+	}
+
+	output := []intermediates{}
+	for _, st := range lines {
+		output = append(output, st)
+	}
+	drop := map[int]bool{}
+
+	for _, para := range noteParagraphs(*input) {
+		if isQuoteParagraph(*input, para) && !hasLeftnotes(*input, para) {
+			continue
+		}
+		for jj := 0; jj < len(para); jj++ {
+			ii := para[jj]
+			st := lines[ii]
+			res := re.FindStringSubmatchIndex(st.text)
+			if res == nil {
+				continue
+			}
+			breakLine := hasLineBreak(st.text)
+			note := st.slice(res[1], len(st.text)).trim(" ")
+			main := st.slice(0, res[3]).trimRight(" ")
+			col := runeLen(st.text[:res[1]]) - 1
+
+			for jj+1 < len(para) && para[jj+1] == para[jj]+1 && continues(para[jj+1], col) {
+				jj++
+				kk := para[jj]
+				part := lines[kk].slice(byteIndex(lines[kk].text, col), len(lines[kk].text))
+				note = note.addString(" ").add(part.trim(" "))
+				main := mainText(lines[kk], col)
+				output[kk] = main
+				if main.text == "" {
+					drop[kk] = true
+				}
+			}
+
+			line := main.addString("  " + ring).add(note)
+			if breakLine {
+				line = line.addString("  ")
+			}
+			output[ii] = line
+		}
+	}
+
+	kept := []intermediates{}
+	for ii, ll := range output {
+		if !drop[ii] {
+			kept = append(kept, ll)
+		}
+	}
+	return plainOutput(*input, kept), nil
+}
+
+func makeNote(input sourceText) ([]Element, error) {
+	elements, err := makeText([]intermediates{input})
+	if err != nil {
+		return elements, err
+	}
+	for _, ee := range elements {
+		if err = (&Note{}).AddElement(ee); err != nil {
+			return elements, newParseError(ErrBadNote, err.Error(), input)
+		}
+	}
+	return elements, err
+}
+
+// Split text at its sidenote markers, putting an empty note between the
+// pieces. The notes are filled in once they have been matched.
+func splitAtMarkers(st sourceText, lefts *([]*Leftnote), rights *([]*Rightnote)) []intermediates {
+	output := []intermediates{}
+	start := 0
+	addPiece := func(end int) {
+		if piece := st.slice(start, end).trim(" "); piece.text != "" {
+			output = append(output, piece)
+		}
+	}
+	for idx, letter := range st.text {
+		switch string(letter) {
+		case dot:
+			addPiece(idx)
+			note := &Leftnote{}
+			*lefts = append(*lefts, note)
+			output = append(output, note)
+			start = idx + len(dot)
+		case ring:
+			addPiece(idx)
+			note := &Rightnote{}
+			*rights = append(*rights, note)
+			output = append(output, note)
+			start = idx + len(ring)
+		}
+	}
+	addPiece(len(st.text))
+	return output
 }
 
 func consumeSidenotes(input *([]intermediates)) ([]intermediates, error) {
@@ -472,59 +941,198 @@ func consumeSidenotes(input *([]intermediates)) ([]intermediates, error) {
 
 	// A footnote may be interspaced
 
-	return *input, nil
-}
+	// Lines arrive linearized: "˙left note  main text  ˚right note"
+	re := rightnoteGap
+	errs := ErrorList{}
 
-func Import(input string) ([]Collection, error) {
-	var intrColl []intermediates
-	var err error
+	pieces := make([][]intermediates, len(*input))
+	for ii, ll := range *input {
+		pieces[ii] = []intermediates{ll}
+	}
 
-	lines := strings.Split(input, "\n")
+	for _, para := range noteParagraphs(*input) {
+		if isQuoteParagraph(*input, para) {
+			continue
+		}
 
-	for _, ll := range lines {
-		intrColl = append(intrColl, ll)
-	}
+		leftNotes := []sourceText{}
+		rightNotes := []sourceText{}
+		lefts := []*Leftnote{}
+		rights := []*Rightnote{}
+		paraPieces := map[int][]intermediates{}
+
+		for _, ii := range para {
+			ss, ok := asSource((*input)[ii])
+			if !ok {
+				continue
+			}
+			breakLine := hasLineBreak(ss.text)
+			lineBreak := sourceText{}
+			if breakLine {
+				lineBreak = ss.slice(len(ss.text)-2, len(ss.text))
+			}
+			ss = ss.trimRight(" ")
+
+			if strings.HasPrefix(ss.text, dot) {
+				var note sourceText
+				note, ss = splitAtGap(ss)
+				leftNotes = append(leftNotes, note)
+			}
+			if loc := re.FindStringIndex(ss.text); loc != nil {
+				rightNotes = append(rightNotes, ss.slice(loc[1]-len(ring), len(ss.text)))
+				ss = ss.slice(0, loc[0])
+			}
+
+			paraPieces[ii] = splitAtMarkers(ss, &lefts, &rights)
+			if strings.HasPrefix(ss.text, "#") && len(paraPieces[ii]) > 1 {
+				//Notes in a header stay with it
+				hl, err := makeHeaderLine(paraPieces[ii])
+				errs.add(err)
+				if hl != nil {
+					paraPieces[ii] = []intermediates{hl}
+					continue
+				}
+			}
+			if breakLine {
+				paraPieces[ii] = append(paraPieces[ii], lineBreak)
+			}
+		}
 
-	/*intrColl, err = linearizeRightnotes(&intrColl)
-	        if err != nil {
-			return []Collection{}, err
+		if len(leftNotes) != len(lefts) || len(rightNotes) != len(rights) {
+			errs.add(newParseError(ErrMismatchedSidenotes, "Mismatched sidenotes", firstNoteLine(*input, para)))
+			continue
+		}
+		if len(lefts) == 0 && len(rights) == 0 {
+			continue
 		}
 
-	        intrColl, err = linearizeLeftnotes(&intrColl)
-	        if err != nil {
-			return []Collection{}, err
-		}*/
+		for kk, note := range leftNotes {
+			elements, err := makeNote(note.slice(len(dot), len(note.text)))
+			errs.add(err)
+			lefts[kk].Elements = elements
+			lefts[kk].Span = sourceSpan(note)
+		}
+		for kk, note := range rightNotes {
+			elements, err := makeNote(note.slice(len(ring), len(note.text)))
+			errs.add(err)
+			rights[kk].Elements = elements
+			rights[kk].Span = sourceSpan(note)
+		}
 
-	intrColl, err = consumeHeaders(&intrColl)
-	if err != nil {
-		return []Collection{}, err
+		for ii, pp := range paraPieces {
+			pieces[ii] = pp
+		}
 	}
 
-	intrColl, err = consumeFootnotes(&intrColl)
-	if err != nil {
-		return []Collection{}, err
+	output := []intermediates{}
+	for _, pp := range pieces {
+		output = append(output, pp...)
 	}
+	return output, errs.err()
+}
 
-	intrColl, err = consumeSidenotes(&intrColl)
-	if err != nil {
-		return []Collection{}, err
+// Import text, reporting every problem found as a ParseError in an
+// ErrorList. The collections read are returned even when there are
+// errors.
+func Import(input string) ([]Collection, error) {
+	output, errs := importText(input, anchorSet{})
+	return output, errs.err()
+}
+
+// Import one piece of a document. Headers take their anchors from the
+// set, which the pieces of a document share.
+func importText(input string, anchors anchorSet) ([]Collection, ErrorList) {
+	intrColl := sourceLines(input)
+	errs := ErrorList{}
+	errs.add(checkEncoding(input))
+	errs.add(checkNormalized(input))
+
+	// Sidenotes are read from the layout of the raw lines, so they go
+	// before anything else reshapes them
+	passes := []func(*([]intermediates)) ([]intermediates, error){
+		linearizeRightnotes,
+		linearizeLeftnotes,
+		consumeSidenotes,
+		consumeHeaders,
+		consumeFootnotes,
+		consumeQuotes,
+		func(input *([]intermediates)) ([]intermediates, error) {
+			return consumeParagraphs(input, anchors)
+		},
+	}
+	for _, pass := range passes {
+		var err error
+		intrColl, err = pass(&intrColl)
+		errs.add(err)
 	}
 
-	intrColl, err = consumeQuotes(&intrColl)
+	output, err := convertToCollection(&intrColl)
+	errs.add(err)
+
+	index := newLineIndex(input)
+	for _, sp := range documentSpans(output) {
+		sp.locate(index)
+	}
+	errs.locate(input)
+	return output, errs
+}
+
+func Rejustify(input []string) (string, error) {
+	return strings.Join(input, "\n"), nil
+}
+
+// Reformat text -> text, laying out the footnote and sidenote channels
+// again at the given widths
+func Reformat(input string, jj Justification) (string, error) {
+	coll, err := Import(input)
 	if err != nil {
-		return []Collection{}, err
+		return "", err
 	}
 
-	intrColl, err = consumeParagraphs(&intrColl)
+	lines, err := jj.Lines(coll)
 	if err != nil {
-		return []Collection{}, err
+		return "", err
 	}
 
-	output, err := convertToCollection(&intrColl)
+	return Rejustify(lines)
+}
 
-	return output, err
+// CheckCanonical reports the first line of input that Reformat at the
+// given widths would change. Input in canonical form ends with a newline.
+func CheckCanonical(input string, jj Justification) error {
+	output, err := Reformat(input, jj)
+	if err != nil {
+		return err
+	}
+	output += "\n"
+	if output == input {
+		return nil
+	}
+	return notCanonical(input, output)
 }
 
-func Rejustify(input []string) (string, error) {
-	return strings.Join(input, "\n"), nil
+// The error for the first line of input that differs from output, the
+// canonical form of it
+func notCanonical(input, output string) ErrorList {
+	inLines := strings.SplitAfter(input, "\n")
+	outLines := strings.SplitAfter(output, "\n")
+	offset := 0
+	ii := 0
+	for ; ii < len(inLines) && ii < len(outLines); ii++ {
+		if inLines[ii] != outLines[ii] {
+			break
+		}
+		offset += len(inLines[ii])
+	}
+
+	expected := "end of file"
+	if outLines[ii] != "" {
+		expected = fmt.Sprintf("%q", strings.TrimSuffix(outLines[ii], "\n"))
+	}
+	errs := ErrorList{newParseError(ErrNotCanonical, "Not in canonical form, expected "+expected,
+		newSource(strings.TrimSuffix(inLines[ii], "\n"), offset))}
+	// A blank line has no text to carry its offset
+	errs[0].Offset = offset
+	errs.locate(input)
+	return errs
 }
@@ -0,0 +1,265 @@
+package process
+
+import (
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Position is a point in the source text. Line and Column count from 1,
+// with Column counted in runes. Offset counts bytes from the start of
+// the input. A zero Line means the position is unknown.
+type Position struct {
+	Line   int
+	Column int
+	Offset int
+}
+
+// Move a position found in a piece of a document to where the piece
+// starts in the whole document, after lines lines and offset bytes
+func (pp *Position) shift(lines, offset int) {
+	if pp.Line != 0 {
+		pp.Line += lines
+		pp.Offset += offset
+	}
+}
+
+// Span is the stretch of source a node was read from, with End just
+// past its last byte. Nodes that were not read from the source have
+// zero Lines.
+type Span struct {
+	Start Position
+	End   Position
+}
+
+// While a document is read only the offsets of a span are known, -1
+// where there is nothing from the source
+func unknownSpan() Span {
+	return Span{Position{Offset: -1}, Position{Offset: -1}}
+}
+
+// The span of source texts given in order
+func sourceSpan(texts ...sourceText) Span {
+	sp := unknownSpan()
+	for _, st := range texts {
+		sp.cover(Span{Position{Offset: st.offset()}, Position{Offset: st.endOffset()}})
+	}
+	return sp
+}
+
+// Grow a span to take in another
+func (sp *Span) cover(other Span) {
+	if other.Start.Offset != -1 && (sp.Start.Offset == -1 || other.Start.Offset < sp.Start.Offset) {
+		sp.Start = other.Start
+	}
+	if other.End.Offset > sp.End.Offset {
+		sp.End = other.End
+	}
+}
+
+// Find the lines and columns of the offsets of a span
+func (sp *Span) locate(index lineIndex) {
+	sp.Start = index.position(sp.Start.Offset)
+	sp.End = index.position(sp.End.Offset)
+}
+
+// Every node read from the source has a span
+type spanned interface {
+	source() *Span
+}
+
+func (sp *Span) source() *Span {
+	return sp
+}
+
+// Grow the span of a block to take in its elements
+func (pp *Block) coverElements() {
+	for _, ee := range pp.Elements {
+		if sn, ok := ee.(spanned); ok {
+			pp.cover(*sn.source())
+		}
+	}
+}
+
+// The spans of every node in a document
+func documentSpans(coll []Collection) []*Span {
+	spans := []*Span{}
+	Walk(coll, VisitFunc(func(nn Node) error {
+		if sn, ok := nn.(spanned); ok {
+			spans = append(spans, sn.source())
+		}
+		return nil
+	}))
+	return spans
+}
+
+// A run of text copied in one piece from the source
+type sourceRun struct {
+	at     int // index in the text where the run begins
+	offset int // source offset of text[at], or -1 for made up text
+}
+
+// Text read from the source, remembering where each of its bytes came
+// from as lines are trimmed, split and joined by the parser
+type sourceText struct {
+	text string
+	runs []sourceRun
+}
+
+func newSource(text string, offset int) sourceText {
+	if text == "" {
+		return sourceText{}
+	}
+	return sourceText{text, []sourceRun{{0, offset}}}
+}
+
+// Text the parser adds, such as the space joining two lines
+func madeUp(text string) sourceText {
+	return newSource(text, -1)
+}
+
+// Split input into lines, each knowing where it starts. Lines may end
+// with \r\n.
+func sourceLines(input string) []intermediates {
+	output := []intermediates{}
+	offset := 0
+	for _, ll := range strings.Split(input, "\n") {
+		output = append(output, newSource(strings.TrimSuffix(ll, "\r"), offset))
+		offset += len(ll) + 1
+	}
+	return output
+}
+
+// Source offset of text[ii], or -1 if it was made up
+func (st sourceText) offsetAt(ii int) int {
+	for kk := len(st.runs) - 1; kk >= 0; kk-- {
+		if st.runs[kk].at <= ii {
+			if st.runs[kk].offset == -1 {
+				return -1
+			}
+			return st.runs[kk].offset + ii - st.runs[kk].at
+		}
+	}
+	return -1
+}
+
+// Source offset of the first byte of text that came from the source
+func (st sourceText) offset() int {
+	for _, rr := range st.runs {
+		if rr.offset != -1 {
+			return rr.offset
+		}
+	}
+	return -1
+}
+
+// Source offset just past the last byte of text from the source
+func (st sourceText) endOffset() int {
+	for kk := len(st.runs) - 1; kk >= 0; kk-- {
+		if st.runs[kk].offset != -1 {
+			end := len(st.text)
+			if kk+1 < len(st.runs) {
+				end = st.runs[kk+1].at
+			}
+			return st.runs[kk].offset + end - st.runs[kk].at
+		}
+	}
+	return -1
+}
+
+func (st sourceText) slice(ii, jj int) sourceText {
+	if ii >= jj {
+		return sourceText{}
+	}
+	output := sourceText{text: st.text[ii:jj]}
+	output.runs = append(output.runs, sourceRun{0, st.offsetAt(ii)})
+	for _, rr := range st.runs {
+		if rr.at > ii && rr.at < jj {
+			output.runs = append(output.runs, sourceRun{rr.at - ii, rr.offset})
+		}
+	}
+	return output
+}
+
+func (st sourceText) add(other sourceText) sourceText {
+	sb := sourceBuilder{}
+	sb.add(st)
+	sb.add(other)
+	return sb.source()
+}
+
+// sourceBuilder joins source texts without copying the text it holds on
+// each addition
+type sourceBuilder struct {
+	text strings.Builder
+	runs []sourceRun
+}
+
+func (sb *sourceBuilder) add(other sourceText) {
+	if other.text == "" {
+		return
+	}
+	at := sb.text.Len()
+	sb.text.WriteString(other.text)
+	for _, rr := range other.runs {
+		rr.at += at
+		// Keep a single run for text that carries on in the source
+		if len(sb.runs) != 0 {
+			last := sb.runs[len(sb.runs)-1]
+			if last.offset == -1 && rr.offset == -1 {
+				continue
+			}
+			if last.offset != -1 && last.offset+rr.at-last.at == rr.offset {
+				continue
+			}
+		}
+		sb.runs = append(sb.runs, rr)
+	}
+}
+
+func (sb *sourceBuilder) source() sourceText {
+	return sourceText{sb.text.String(), sb.runs}
+}
+
+func (st sourceText) addString(ss string) sourceText {
+	return st.add(madeUp(ss))
+}
+
+func (st sourceText) trimLeft(cutset string) sourceText {
+	return st.slice(len(st.text)-len(strings.TrimLeft(st.text, cutset)), len(st.text))
+}
+
+func (st sourceText) trimRight(cutset string) sourceText {
+	return st.slice(0, len(strings.TrimRight(st.text, cutset)))
+}
+
+func (st sourceText) trim(cutset string) sourceText {
+	return st.trimLeft(cutset).trimRight(cutset)
+}
+
+// Where offsets fall in the input, as lines and columns
+type lineIndex struct {
+	input  string
+	starts []int
+}
+
+func newLineIndex(input string) lineIndex {
+	starts := []int{0}
+	for ii := 0; ii < len(input); ii++ {
+		if input[ii] == '\n' {
+			starts = append(starts, ii+1)
+		}
+	}
+	return lineIndex{input, starts}
+}
+
+func (li lineIndex) position(offset int) Position {
+	if offset < 0 || offset > len(li.input) {
+		return Position{Offset: offset}
+	}
+	line := sort.Search(len(li.starts), func(ii int) bool {
+		return li.starts[ii] > offset
+	}) - 1
+	column := utf8.RuneCountInString(li.input[li.starts[line]:offset]) + 1
+	return Position{line + 1, column, offset}
+}
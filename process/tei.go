@@ -0,0 +1,158 @@
+package process
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A document as TEI P5 XML, in the manner of the Perseus and EpiDoc
+// editions. The body is a div of type "edition" holding the text, with
+// each header opening a div of type "textpart" that runs to the next
+// header of its level or above. Paragraphs are p, notes are note with
+// place "foot", "margin-left" or "margin-right", quotations are quote
+// and q, in a cit with a bibl when they have a citation, emphasis is hi
+// and line breaks are lb.
+
+const teiNamespace = "http://www.tei-c.org/ns/1.0"
+
+func teiText(ee Element) string {
+	switch ee.(type) {
+	case *Emphasis:
+		em := ee.(*Emphasis)
+		rend := []string{}
+		if em.Strong {
+			rend = append(rend, "bold")
+		}
+		if em.Em {
+			rend = append(rend, "italic")
+		}
+		if len(rend) == 0 {
+			return escapeHtml(em.content)
+		}
+		return "<hi rend=\"" + strings.Join(rend, " ") + "\">" + escapeHtml(em.content) + "</hi>"
+	}
+	return escapeHtml(textOf(ee).content)
+}
+
+func teiNote(place string, nn *Note) string {
+	return "<note place=\"" + place + "\">" + teiElements(nn.Elements) + "</note>"
+}
+
+func teiElements(elements []Element) string {
+	output := ""
+	spaceNeeded := false
+
+	for _, ee := range elements {
+		switch ee.(type) {
+		case nil:
+		case *Text, *Emphasis:
+			if spaceNeeded && !joinsPrevious(ee) {
+				output += " "
+			}
+			output += teiText(ee)
+			spaceNeeded = true
+		case *LineBreak:
+			output += "\n<lb/>"
+			spaceNeeded = false
+		case *Footnote:
+			output += teiNote("foot", &ee.(*Footnote).Note)
+			spaceNeeded = true
+		case *Rightnote:
+			output += teiNote("margin-right", &ee.(*Rightnote).Note)
+			spaceNeeded = true
+		case *Leftnote:
+			if spaceNeeded {
+				output += " "
+			}
+			output += teiNote("margin-left", &ee.(*Leftnote).Note)
+			spaceNeeded = false
+		case *InlineQuote:
+			iq := ee.(*InlineQuote)
+			if spaceNeeded {
+				output += " "
+			}
+			quote := "<q>" + teiElements(iq.Elements) + "</q>"
+			if iq.Citation != "" {
+				quote = "<cit>" + quote + " <bibl>" + escapeHtml(iq.Citation) + "</bibl></cit>"
+			}
+			output += quote
+			spaceNeeded = true
+		}
+	}
+	return output
+}
+
+// An anchor is kept as an xml:id when it is a name xml allows
+func teiId(hh *Header) string {
+	rr, _ := utf8.DecodeRuneInString(hh.Id)
+	if !unicode.IsLetter(rr) {
+		return ""
+	}
+	return " xml:id=\"" + escapeAttr(hh.Id) + "\""
+}
+
+func teiQuote(bq *BlockQuote) string {
+	output := "<quote>\n"
+	for _, pp := range bq.Paragraphs {
+		output += "<p>" + teiElements(pp.Elements) + "</p>\n"
+	}
+	output += "</quote>"
+	if bq.Citation != "" {
+		output = "<cit>\n" + output + "\n<bibl>" + escapeHtml(bq.Citation) + "</bibl>\n</cit>"
+	}
+	return output
+}
+
+// TeiDocument writes the collections of a document as TEI, with a
+// minimal teiHeader titled by the first level 1 header
+func TeiDocument(coll []Collection) (string, error) {
+	output := "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n"
+	output += "<TEI xmlns=\"" + teiNamespace + "\">\n"
+	output += "<teiHeader>\n"
+	output += "<fileDesc>\n"
+	output += "<titleStmt>\n"
+	output += "<title>" + escapeHtml(documentTitle(coll)) + "</title>\n"
+	output += "</titleStmt>\n"
+	output += "<publicationStmt>\n"
+	output += "<p>Converted from Marginalia text.</p>\n"
+	output += "</publicationStmt>\n"
+	output += "<sourceDesc>\n"
+	output += "<p>Marginalia text.</p>\n"
+	output += "</sourceDesc>\n"
+	output += "</fileDesc>\n"
+	output += "</teiHeader>\n"
+	output += "<text>\n"
+	output += "<body>\n"
+	output += "<div type=\"edition\">\n"
+
+	// The levels of the headers whose divs are open
+	levels := []int{}
+	for _, cc := range coll {
+		if err := Check(cc); err != nil {
+			return "", err
+		}
+		switch cc.(type) {
+		case *Header:
+			hh := cc.(*Header)
+			for len(levels) != 0 && levels[len(levels)-1] >= hh.Level {
+				output += "</div>\n"
+				levels = levels[:len(levels)-1]
+			}
+			levels = append(levels, hh.Level)
+			output += "<div type=\"textpart\"" + teiId(hh) + ">\n"
+			output += "<head>" + teiElements(hh.Elements) + "</head>\n"
+		case *Paragraph:
+			output += "<p>" + teiElements(cc.(*Paragraph).Elements) + "</p>\n"
+		case *BlockQuote:
+			output += teiQuote(cc.(*BlockQuote)) + "\n"
+		}
+	}
+	output += strings.Repeat("</div>\n", len(levels))
+
+	output += "</div>\n"
+	output += "</body>\n"
+	output += "</text>\n"
+	output += "</TEI>"
+	return output, nil
+}
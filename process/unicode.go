@@ -0,0 +1,165 @@
+package process
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Marginalia documents are UTF-8 NFC Unicode. The tables cover the
+// scripts editions are written in; other characters are taken as they
+// are.
+
+var compositions = map[[2]rune]rune{}
+
+func init() {
+	for cc, parts := range decompositions {
+		if len(parts) == 2 && !compositionExclusions[cc] {
+			compositions[[2]rune{parts[0], parts[1]}] = cc
+		}
+	}
+}
+
+func combiningClass(rr rune) uint8 {
+	ii := sort.Search(len(combiningClasses), func(ii int) bool {
+		return combiningClasses[ii].hi >= rr
+	})
+	if ii < len(combiningClasses) && combiningClasses[ii].lo <= rr {
+		return combiningClasses[ii].class
+	}
+	return 0
+}
+
+// Append the full canonical decomposition of rr
+func decompose(rr rune, output []rune) []rune {
+	parts, ok := decompositions[rr]
+	if !ok {
+		return append(output, rr)
+	}
+	for _, pp := range parts {
+		output = decompose(pp, output)
+	}
+	return output
+}
+
+// Normalize rewrites text to NFC. The deprecated Greek letters with
+// oxia, such as U+1F71, become the same letters with tonos.
+func Normalize(input string) string {
+	runes := []rune{}
+	for _, rr := range input {
+		runes = decompose(rr, runes)
+	}
+
+	// Put combining marks in canonical order
+	for ii := 1; ii < len(runes); ii++ {
+		cc := combiningClass(runes[ii])
+		if cc == 0 {
+			continue
+		}
+		for jj := ii; jj > 0; jj-- {
+			prev := combiningClass(runes[jj-1])
+			if prev == 0 || prev <= cc {
+				break
+			}
+			runes[jj], runes[jj-1] = runes[jj-1], runes[jj]
+		}
+	}
+
+	// Compose each mark with its starter, unless another mark of the
+	// same class or a starter comes between them
+	output := []rune{}
+	starter := -1
+	var lastClass uint8
+	for _, rr := range runes {
+		cc := combiningClass(rr)
+		if starter != -1 && (len(output)-1 == starter || (lastClass != 0 && lastClass < cc)) {
+			if composed, ok := compositions[[2]rune{output[starter], rr}]; ok {
+				output[starter] = composed
+				continue
+			}
+		}
+		if cc == 0 {
+			starter = len(output)
+		}
+		lastClass = cc
+		output = append(output, rr)
+	}
+
+	return string(output)
+}
+
+// Report each run of a character and its combining marks that is not
+// in NFC. Invalid UTF-8 is not reported here.
+func checkNormalized(input string) error {
+	errs := ErrorList{}
+	start := 0
+	checkRun := func(end int) {
+		run := input[start:end]
+		if utf8.ValidString(run) && Normalize(run) != run {
+			errs.add(newParseError(ErrNotNormalized, "Text is not NFC", newSource(run, start)))
+		}
+		start = end
+	}
+	for idx, rr := range input {
+		if combiningClass(rr) == 0 {
+			checkRun(idx)
+		}
+	}
+	checkRun(len(input))
+	return errs.err()
+}
+
+// Report invalid UTF-8, replacement characters left by an earlier bad
+// conversion, control characters and tabs. A run of bad bytes is one
+// error. A carriage return ending a line is not a control character.
+func checkEncoding(input string) error {
+	errs := ErrorList{}
+	report := func(code ErrorCode, message string, idx, end int) {
+		pe := newParseError(code, message, newSource(input[idx:end], idx))
+		pe.Snippet = fmt.Sprintf("%q", input[idx:end])
+		errs.add(pe)
+	}
+	for idx := 0; idx < len(input); {
+		rr, size := utf8.DecodeRuneInString(input[idx:])
+		switch {
+		case rr == utf8.RuneError && size == 1:
+			end := idx + 1
+			for end < len(input) {
+				if rr, size := utf8.DecodeRuneInString(input[end:]); rr != utf8.RuneError || size != 1 {
+					break
+				}
+				end++
+			}
+			report(ErrInvalidEncoding, "Invalid UTF-8", idx, end)
+			size = end - idx
+		case rr == utf8.RuneError:
+			report(ErrInvalidEncoding, "Replacement character in text", idx, idx+size)
+		case rr == '\t':
+			report(ErrTab, "Tab in text", idx, idx+size)
+		case rr == '\r' && strings.HasPrefix(input[idx+size:], "\n"):
+		case rr != '\n' && unicode.IsControl(rr):
+			report(ErrControlCharacter, "Control character in text", idx, idx+size)
+		}
+		idx += size
+	}
+	return errs.err()
+}
+
+func isMarkup(rr rune) bool {
+	return strings.ContainsRune(dagger+dot+ring+citation, rr)
+}
+
+// Report mark-up characters in text where the grammar has no place for
+// them
+func checkMarkup(st sourceText) error {
+	errs := ErrorList{}
+	for idx, rr := range st.text {
+		if isMarkup(rr) {
+			errs.add(newParseError(ErrMisplacedMarkup, "Misplaced "+string(rr),
+				st.slice(idx, idx+utf8.RuneLen(rr))))
+		}
+	}
+	return errs.err()
+}
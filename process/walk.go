@@ -0,0 +1,119 @@
+package process
+
+import (
+	"errors"
+)
+
+// Node is a part of a document: a Header, Paragraph or BlockQuote, or
+// an element in one of them. Source is where it was read from.
+type Node interface {
+	Source() Span
+}
+
+func (sp Span) Source() Span {
+	return sp
+}
+
+// Content is the text of a Text or Emphasis element
+func (tt *Text) Content() string {
+	return tt.content
+}
+
+// Visitor is called as Walk enters and leaves each node of a document.
+// An error stops the walk, except for SkipChildren from Enter, which
+// goes on to the Leave of the same node.
+type Visitor interface {
+	Enter(nn Node) error
+	Leave(nn Node) error
+}
+
+// SkipChildren is returned by Enter to leave out the children of a node
+var SkipChildren = errors.New("Skip children")
+
+// VisitFunc is a Visitor that is called only on entering a node
+type VisitFunc func(nn Node) error
+
+func (vf VisitFunc) Enter(nn Node) error {
+	return vf(nn)
+}
+
+func (VisitFunc) Leave(Node) error {
+	return nil
+}
+
+// The children of a node, in document order. Emphasis has none; the
+// paragraphs of a BlockQuote are its children.
+func children(nn Node) ([]Node, error) {
+	elements := []Element{}
+	switch nn.(type) {
+	default:
+		return []Node{}, errors.New("Bad type of Node")
+	case *Text, *Emphasis, *LineBreak:
+	case *Header:
+		elements = nn.(*Header).Elements
+	case *Paragraph:
+		elements = nn.(*Paragraph).Elements
+	case *Footnote:
+		elements = nn.(*Footnote).Elements
+	case *Leftnote:
+		elements = nn.(*Leftnote).Elements
+	case *Rightnote:
+		elements = nn.(*Rightnote).Elements
+	case *InlineQuote:
+		elements = nn.(*InlineQuote).Elements
+	case *BlockQuote:
+		output := []Node{}
+		bq := nn.(*BlockQuote)
+		for ii := range bq.Paragraphs {
+			output = append(output, &bq.Paragraphs[ii])
+		}
+		return output, nil
+	}
+
+	output := []Node{}
+	for _, ee := range elements {
+		if ee == nil {
+			continue
+		}
+		child, ok := ee.(Node)
+		if !ok {
+			return output, errors.New("Bad type in Block")
+		}
+		output = append(output, child)
+	}
+	return output, nil
+}
+
+func walkNode(nn Node, vv Visitor) error {
+	err := vv.Enter(nn)
+	if err == nil {
+		var nodes []Node
+		nodes, err = children(nn)
+		for _, child := range nodes {
+			if err != nil {
+				break
+			}
+			err = walkNode(child, vv)
+		}
+	}
+	if err != nil && err != SkipChildren {
+		return err
+	}
+	return vv.Leave(nn)
+}
+
+// Walk visits every node of a document in order, each node before and
+// after its children. It stops at the first error, which it returns,
+// and at nodes of types it does not know.
+func Walk(coll []Collection, vv Visitor) error {
+	for _, cc := range coll {
+		nn, ok := cc.(Node)
+		if !ok {
+			return errors.New("Bad type of Collection")
+		}
+		if err := walkNode(nn, vv); err != nil {
+			return err
+		}
+	}
+	return nil
+}